@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	followInterval      = 250 * time.Millisecond
+	followChunkSize     = 32 * 1024
+	followStateInterval = time.Second
+)
+
+// followState is the state of the follower persisted between runs.
+type followState struct {
+	Path   string `json:"path"`
+	Device uint64 `json:"device"`
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+// follower is a reader which keeps reading data appended to the file at path,
+// like tail -F. When the file is renamed (based on its device and inode) or
+// truncated (based on its size), it reopens the file and reads it from the start.
+//
+// Reads return only complete lines (unless a line is longer than the read buffer)
+// so that the offset of the data returned is at a line boundary and can be persisted
+// to a state file, for restarts to resume where the previous run stopped.
+// After the file is reopened, reads return io.EOF once all data of the previous
+// file has been returned, until Next is called, so that every file is read
+// (and its offsets counted) separately.
+// The state is saved after data returned by previous reads has been processed: on reads
+// at most once per followStateInterval, when waiting for more data, and when following
+// is stopped.
+type follower struct {
+	path      string
+	statePath string
+	logger    *log.Logger
+	// Closed when following should stop.
+	done chan struct{}
+
+	file *os.File
+	// Data read from the file but not yet returned.
+	buf []byte
+	// Offset in the file of the first byte in buf.
+	offset int64
+	// Offset in the file at which the last returned line ended.
+	committed int64
+	// Offset last saved to the state file.
+	saved int64
+	// When the state was last saved.
+	savedAt time.Time
+	// Partial last line of the previous file, returned before data from the new file.
+	pending []byte
+	// Set when the file has been reopened, until Next is called.
+	reopened bool
+}
+
+// newFollower opens the file at path, waiting for it to exist, and resumes reading
+// it at the offset stored in the state file at statePath, if provided and if the state
+// is for the same file.
+func newFollower(path, statePath string, logger *log.Logger) (*follower, error) {
+	f := &follower{
+		path:      path,
+		statePath: statePath,
+		logger:    logger,
+		done:      make(chan struct{}),
+		file:      nil,
+		buf:       nil,
+		offset:    0,
+		committed: 0,
+		saved:     -1,
+		savedAt:   time.Time{},
+		pending:   nil,
+		reopened:  false,
+	}
+
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.resume()
+	if err != nil {
+		f.file.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Name returns the path of the followed file.
+func (f *follower) Name() string {
+	return f.path
+}
+
+// Offset returns the offset in the file of the data returned by the next read.
+// It is used by regex2json.Transformer as the offset of the first line.
+func (f *follower) Offset() int64 {
+	return f.offset
+}
+
+// Next continues reading the file which has been reopened, after reads of
+// the previous file returned io.EOF. It returns false if following has been stopped.
+func (f *follower) Next() bool {
+	select {
+	case <-f.done:
+		return false
+	default:
+	}
+	f.reopened = false
+	return true
+}
+
+// Stop stops following. The next read saves the state and returns io.EOF.
+// It can be called concurrently with reads, but only once.
+func (f *follower) Stop() {
+	close(f.done)
+}
+
+// wait waits for the data to be appended to the file. It returns
+// false if following has been stopped.
+func (f *follower) wait() bool {
+	select {
+	case <-f.done:
+		return false
+	case <-time.After(followInterval):
+		return true
+	}
+}
+
+func (f *follower) open() error {
+	warned := false
+	for {
+		file, err := os.Open(f.path)
+		if err == nil {
+			f.file = file
+			return nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err //nolint:wrapcheck
+		}
+		if !warned {
+			f.logger.Printf(`waiting for file "%s" to exist`, f.path)
+			warned = true
+		}
+		if !f.wait() {
+			return io.EOF
+		}
+	}
+}
+
+func (f *follower) resume() error {
+	if f.statePath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(f.statePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to read state file: %w", err)
+	}
+
+	var state followState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return fmt.Errorf("unable to parse state file: %w", err)
+	}
+
+	info, err := f.file.Stat()
+	if err != nil {
+		return fmt.Errorf("unable to stat file: %w", err)
+	}
+	device, inode := fileID(info)
+
+	if state.Path != f.path || state.Device != device || state.Inode != inode || state.Offset > info.Size() {
+		f.logger.Printf(`state file "%s" is for a different file, reading from the start`, f.statePath)
+		return nil
+	}
+
+	_, err = f.file.Seek(state.Offset, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("unable to seek: %w", err)
+	}
+	f.offset = state.Offset
+	f.committed = state.Offset
+	f.saved = state.Offset
+	return nil
+}
+
+// saveState atomically writes the committed offset to the state file.
+func (f *follower) saveState() {
+	if f.statePath == "" || f.committed == f.saved {
+		return
+	}
+
+	info, err := f.file.Stat()
+	if err != nil {
+		f.logger.Printf("unable to stat file: %s", err)
+		return
+	}
+	device, inode := fileID(info)
+
+	data, err := json.Marshal(followState{
+		Path:   f.path,
+		Device: device,
+		Inode:  inode,
+		Offset: f.committed,
+	})
+	if err != nil {
+		f.logger.Printf("unable to marshal state: %s", err)
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.statePath), filepath.Base(f.statePath)+".*")
+	if err != nil {
+		f.logger.Printf("unable to write state file: %s", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	errClose := tmp.Close()
+	if err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.statePath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		f.logger.Printf("unable to write state file: %s", err)
+		return
+	}
+
+	f.saved = f.committed
+	f.savedAt = time.Now()
+}
+
+// Read implements io.Reader interface. It blocks until at least one
+// complete line is available or following is stopped.
+func (f *follower) Read(p []byte) (int, error) {
+	// All data returned by previous calls has been processed by now.
+	if time.Since(f.savedAt) >= followStateInterval {
+		f.saveState()
+	}
+
+	for {
+		select {
+		case <-f.done:
+			f.saveState()
+			return 0, io.EOF
+		default:
+		}
+
+		if len(f.pending) > 0 {
+			n := copy(p, f.pending)
+			f.pending = f.pending[n:]
+			return n, nil
+		}
+
+		if f.reopened {
+			return 0, io.EOF
+		}
+
+		if i := bytes.LastIndexByte(f.buf, '\n'); i >= 0 {
+			n := copy(p, f.buf[:i+1])
+			f.buf = f.buf[n:]
+			f.offset += int64(n)
+			if p[n-1] == '\n' {
+				f.committed = f.offset
+			}
+			return n, nil
+		}
+
+		if len(f.buf) > bufio.MaxScanTokenSize {
+			// The line is too long to be read by regex2json.Transformer anyway,
+			// so we do not buffer it further.
+			return 0, bufio.ErrTooLong
+		}
+
+		chunk := make([]byte, followChunkSize)
+		n, err := f.file.Read(chunk)
+		f.buf = append(f.buf, chunk[:n]...)
+		if n > 0 {
+			continue
+		} else if err != nil && !errors.Is(err, io.EOF) {
+			return 0, err //nolint:wrapcheck
+		}
+
+		rotated, err := f.checkRotation()
+		if err != nil {
+			return 0, err
+		}
+		if !rotated {
+			// We save the state while there is no data to process.
+			f.saveState()
+			if !f.wait() {
+				return 0, io.EOF
+			}
+		}
+	}
+}
+
+// checkRotation checks if the file at path has been replaced or truncated
+// and reopens it if so.
+func (f *follower) checkRotation() (bool, error) {
+	pathInfo, err := os.Stat(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		// File has been renamed but the new one has not yet been created.
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("unable to stat file: %w", err)
+	}
+
+	fileInfo, err := f.file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("unable to stat file: %w", err)
+	}
+
+	if !os.SameFile(pathInfo, fileInfo) {
+		f.logger.Printf(`file "%s" has been rotated, reopening`, f.path)
+		// We have read the old file to the end, so we return any partial last line.
+		f.pending = f.buf
+		f.file.Close()
+		err := f.open()
+		if err != nil {
+			return false, err
+		}
+		f.reset()
+		return true, nil
+	}
+
+	if pathInfo.Size() < f.offset+int64(len(f.buf)) {
+		f.logger.Printf(`file "%s" has been truncated, reading from the start`, f.path)
+		_, err := f.file.Seek(0, io.SeekStart)
+		if err != nil {
+			return false, fmt.Errorf("unable to seek: %w", err)
+		}
+		f.reset()
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (f *follower) reset() {
+	f.buf = nil
+	f.offset = 0
+	f.committed = 0
+	// We force saving the state for the new file.
+	f.saved = -1
+	f.reopened = true
+}
+
+// Close closes the followed file.
+func (f *follower) Close() error {
+	return f.file.Close() //nolint:wrapcheck
+}
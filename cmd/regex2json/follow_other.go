@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import (
+	"io/fs"
+)
+
+// fileID returns the device and inode of the file.
+// They are not available on this platform, so it returns zeros.
+func fileID(_ fs.FileInfo) (uint64, uint64) {
+	return 0, 0
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/tozd/regex2json"
+)
+
+// readFollower reads from f until at least n bytes have been read.
+func readFollower(t *testing.T, f *follower, n int) string {
+	t.Helper()
+
+	res := []byte{}
+	buf := make([]byte, 1024)
+	for len(res) < n {
+		m, err := f.Read(buf)
+		require.NoError(t, err)
+		res = append(res, buf[:m]...)
+	}
+	return string(res)
+}
+
+func appendFile(t *testing.T, path, data string) {
+	t.Helper()
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	require.NoError(t, err)
+	_, err = file.WriteString(data)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+}
+
+func TestFollowerRotate(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "input.log")
+	appendFile(t, path, "a\nb\n")
+
+	f, err := newFollower(path, "", log.New(io.Discard, "", 0))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		f.Close()
+	})
+
+	assert.Equal(t, "a\nb\n", readFollower(t, f, 4))
+
+	// Data appended to the old file after it has been renamed is still read,
+	// including the partial last line.
+	err = os.Rename(path, path+".1")
+	require.NoError(t, err)
+	appendFile(t, path+".1", "c\nd")
+	appendFile(t, path, "e\n")
+
+	assert.Equal(t, "c\nd", readFollower(t, f, 3))
+	_, err = f.Read(make([]byte, 1024))
+	assert.ErrorIs(t, err, io.EOF)
+
+	require.True(t, f.Next())
+	assert.Equal(t, int64(0), f.Offset())
+	assert.Equal(t, "e\n", readFollower(t, f, 2))
+}
+
+func TestFollowerTruncate(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "input.log")
+	appendFile(t, path, "aaa\nbbb\n")
+
+	f, err := newFollower(path, "", log.New(io.Discard, "", 0))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		f.Close()
+	})
+
+	assert.Equal(t, "aaa\nbbb\n", readFollower(t, f, 8))
+
+	err = os.Truncate(path, 0)
+	require.NoError(t, err)
+	appendFile(t, path, "c\n")
+
+	_, err = f.Read(make([]byte, 1024))
+	assert.ErrorIs(t, err, io.EOF)
+
+	require.True(t, f.Next())
+	assert.Equal(t, int64(0), f.Offset())
+	assert.Equal(t, "c\n", readFollower(t, f, 2))
+	assert.Equal(t, int64(2), f.Offset())
+}
+
+func TestFollowerTooLong(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "input.log")
+	appendFile(t, path, "a\n"+strings.Repeat("b", bufio.MaxScanTokenSize+1))
+
+	f, err := newFollower(path, "", log.New(io.Discard, "", 0))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		f.Close()
+	})
+
+	assert.Equal(t, "a\n", readFollower(t, f, 2))
+	_, err = f.Read(make([]byte, 1024))
+	assert.ErrorIs(t, err, bufio.ErrTooLong)
+}
+
+func TestFollowerResume(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "input.log")
+	statePath := filepath.Join(dir, "state.json")
+	appendFile(t, path, "a\nb\npartial")
+
+	f, err := newFollower(path, statePath, log.New(io.Discard, "", 0))
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), f.Offset())
+	assert.Equal(t, "a\nb\n", readFollower(t, f, 4))
+
+	// Stopping saves the state of the data which has been read.
+	f.Stop()
+	n, err := f.Read(make([]byte, 1024))
+	assert.Equal(t, 0, n)
+	assert.ErrorIs(t, err, io.EOF)
+	require.NoError(t, f.Close())
+	require.FileExists(t, statePath)
+
+	appendFile(t, path, "\nc\n")
+
+	f, err = newFollower(path, statePath, log.New(io.Discard, "", 0))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		f.Close()
+	})
+	assert.Equal(t, int64(4), f.Offset())
+	assert.Equal(t, "partial\nc\n", readFollower(t, f, 10))
+}
+
+func TestFollowerSaveState(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "input.log")
+	statePath := filepath.Join(dir, "state.json")
+	appendFile(t, path, "a\nb\n")
+
+	f, err := newFollower(path, statePath, log.New(io.Discard, "", 0))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		f.Close()
+	})
+
+	readOffset := func() int64 {
+		t.Helper()
+		data, err := os.ReadFile(statePath)
+		require.NoError(t, err)
+		var state followState
+		require.NoError(t, json.Unmarshal(data, &state))
+		return state.Offset
+	}
+
+	assert.Equal(t, "a\nb\n", readFollower(t, f, 4))
+	appendFile(t, path, "c\n")
+	// The state is not saved on every read.
+	assert.Equal(t, "c\n", readFollower(t, f, 2))
+	assert.Equal(t, int64(0), readOffset())
+
+	// But it is saved while waiting for more data.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := f.Read(make([]byte, 1024))
+		assert.ErrorIs(t, err, io.EOF)
+	}()
+	require.Eventually(t, func() bool {
+		return readOffset() == 6
+	}, 5*time.Second, 10*time.Millisecond)
+	f.Stop()
+	<-done
+}
+
+func TestFollowerResumeDifferentFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "input.log")
+	statePath := filepath.Join(dir, "state.json")
+	appendFile(t, path, "a\nb\n")
+
+	f, err := newFollower(path, statePath, log.New(io.Discard, "", 0))
+	require.NoError(t, err)
+	assert.Equal(t, "a\nb\n", readFollower(t, f, 4))
+	f.Stop()
+	_, err = f.Read(make([]byte, 1024))
+	assert.ErrorIs(t, err, io.EOF)
+	require.NoError(t, f.Close())
+
+	// The file is replaced, so reading starts from the start.
+	err = os.Remove(path)
+	require.NoError(t, err)
+	appendFile(t, path, "c\n")
+
+	f, err = newFollower(path, statePath, log.New(io.Discard, "", 0))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		f.Close()
+	})
+	assert.Equal(t, int64(0), f.Offset())
+	assert.Equal(t, "c\n", readFollower(t, f, 2))
+}
+
+// syncBuffer is a bytes.Buffer which can be written and read concurrently.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestTransformFollowerOffsets(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "input.log")
+	appendFile(t, path, "a\nbb\n")
+
+	transformer := regex2json.Transformer{ //nolint:exhaustruct
+		Regexp: regexp.MustCompile(`^(?P<value>.+)$`),
+		MetadataKeys: regex2json.MetadataKeys{ //nolint:exhaustruct
+			Line:   "line",
+			Offset: "offset",
+		},
+	}
+	compiled, err := transformer.Compile()
+	require.NoError(t, err)
+
+	f, err := newFollower(path, "", log.New(io.Discard, "", 0))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		f.Close()
+	})
+
+	out := &syncBuffer{} //nolint:exhaustruct
+	encoder := regex2json.NewJSONEncoder(out)
+	done := make(chan error)
+	go func() {
+		done <- transformFollower(compiled, f, encoder, io.Discard, encoder)
+	}()
+
+	waitLines := func(n int) {
+		t.Helper()
+		require.Eventually(t, func() bool {
+			return strings.Count(out.String(), "\n") >= n
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	waitLines(2)
+
+	err = os.Truncate(path, 0)
+	require.NoError(t, err)
+	appendFile(t, path, "ccc\n")
+
+	waitLines(3)
+
+	err = os.Rename(path, path+".1")
+	require.NoError(t, err)
+	appendFile(t, path+".1", "dddd\ne")
+	appendFile(t, path, "ff\n")
+
+	waitLines(6)
+
+	f.Stop()
+	require.NoError(t, <-done)
+
+	assert.Equal(t, `{"line":1,"offset":0,"value":"a"}
+{"line":2,"offset":2,"value":"bb"}
+{"line":1,"offset":0,"value":"ccc"}
+{"line":2,"offset":4,"value":"dddd"}
+{"line":3,"offset":9,"value":"e"}
+{"line":1,"offset":0,"value":"ff"}
+`, out.String())
+}
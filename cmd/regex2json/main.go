@@ -1,4 +1,4 @@
-// Regex2json reads lines from stdin, matching every line with the provided regexp.
+// Regex2json reads lines from files or stdin, matching every line with the provided regexp.
 // If line matches, values from captured named groups are mapped into output JSON
 // which is then written out to stdout. If the line does not match, it is written
 // to stderr.
@@ -15,7 +15,89 @@
 //
 // Usage:
 //
-//	regex2json <regexp>
+//	regex2json [flags] <regexp> [file ...]
+//
+// Files are read in order and can be globs. If no files are provided or a file
+// is "-", lines are read from stdin. Files which cannot be read are skipped with
+// a warning and the program exits with failure after other files are read.
+// The same is done with the rest of a file after a line longer than 64 KiB.
+// Compressed files (gzip, bzip2, zstd, xz) are detected by their magic bytes
+// and decompressed.
+//
+// With -follow, exactly one file is read and data appended to it is read as
+// it is written, like with tail -F. When the file is renamed or truncated
+// (e.g., by a log rotation), it is reopened and offsets and line numbers are counted
+// from the start of the new file. With -state-file, the offset of
+// the last processed line is persisted so that a restart resumes from it,
+// with offsets continuing from there. On SIGINT or SIGTERM, lines which have
+// been read are processed and the state is saved before exiting.
+//
+// Flags:
+//
+//	-alias name=expression
+//	      Expression used instead of capture group's name. Can be repeated.
+//	-merge strategy
+//	      Merge strategy for conflicting values: error, first, last, or collect. Default is error.
+//	-errors-key key
+//	      Add errors applying expressions to output JSON under this key instead of logging them.
+//	-unmatched-key key
+//	      Write unmatched lines as JSON with the line under this key to stdout instead of raw to stderr.
+//	-unmatched-flag-key key
+//	      Key set to true in JSON for unmatched lines. Default is _unmatched.
+//	-unmatched-output path
+//	      File to which unmatched lines are appended instead.
+//	-line-key key
+//	      Add line number to output JSON under this key.
+//	-offset-key key
+//	      Add byte offset of the line to output JSON under this key.
+//	-source-key key
+//	      Add name of the input file to output JSON under this key.
+//	-time-key key
+//	      Add time when the line was read to output JSON under this key.
+//	-raw-key key
+//	      Add raw line to output JSON under this key.
+//	-regexp-key key
+//	      Add regexp which matched the line to output JSON under this key.
+//	-decompress compression
+//	      Compression of stdin: auto, none, gzip, bzip2, zstd, or xz. Default is auto.
+//	-order-fields
+//	      Encode fields in the order of capture groups instead of alphabetically.
+//	-field-order field[,field...]
+//	      Order of fields, with nested keys joined with a dot, before the order of capture groups.
+//	      Any byte in keys can be written as an escape _xHH_ (e.g., _x2e_ for a dot).
+//	-format format
+//	      Output format: json, pretty, csv, tsv, logfmt, or yaml. Default is json.
+//	-columns column[,column...]
+//	      Columns for csv and tsv formats, with nested keys joined with a dot.
+//	      By default, keys of the first output JSON are used. Required with -unmatched-key.
+//	-output path
+//	      File to which output is appended instead of stdout. Reopened on SIGHUP.
+//	-rotate-size size
+//	      Rotate output file when it would exceed this size in bytes.
+//	-rotate-interval duration
+//	      Rotate output file every duration (e.g., 24h).
+//	-retain count
+//	      Keep only this count of rotated output files.
+//	-compress-rotated
+//	      Compress rotated output files with gzip.
+//	-input-encoding encoding
+//	      Character encoding of input (e.g., ISO-8859-1, windows-1252, UTF-16LE), decoded into UTF-8.
+//	-invalid-utf8 policy
+//	      Policy for lines with invalid UTF-8: keep, replace, escape, or unmatched. Default is keep.
+//	-follow
+//	      Keep reading data appended to the file, reopening it when it is rotated or truncated.
+//	-state-file path
+//	      File in which to persist the read offset when following, to resume from it.
+//	-pattern name=regexp
+//	      Named regexp available to the regex operator. Can be repeated.
+//	-network name=cidr[,cidr...]
+//	      Named network ranges available to the cidr operator. Can be repeated.
+//	-geoip path
+//	      Local MaxMind database (.mmdb) available to the geoip operator. Can be repeated.
+//	-hash-key name=env:VAR|file:path
+//	      Named key available to the hash operator, read from an environment variable or a file. Can be repeated.
+//	-useragent-rules path
+//	      JSON file with rules used by the useragent operator instead of embedded rules.
 //
 // Example:
 //
@@ -32,9 +114,20 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"strings"
+	"syscall"
+	"time"
 
 	"gitlab.com/tozd/regex2json"
 )
@@ -45,26 +138,444 @@ const (
 	// 2 is used when Golang runtime fails due to an unrecovered panic or an unexpected runtime condition.
 )
 
+// keyValues is a flag which can be repeated, each time with a name=value pair.
+type keyValues [][2]string
+
+func (k *keyValues) String() string {
+	pairs := []string{}
+	for _, kv := range *k {
+		pairs = append(pairs, kv[0]+"="+kv[1])
+	}
+	return strings.Join(pairs, ", ")
+}
+
+func (k *keyValues) Set(value string) error {
+	name, v, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf(`expected name=value, got "%s"`, value) //nolint:err113
+	}
+	*k = append(*k, [2]string{name, v})
+	return nil
+}
+
+// values is a flag which can be repeated.
+type values []string
+
+func (v *values) String() string {
+	return strings.Join(*v, ", ")
+}
+
+func (v *values) Set(value string) error {
+	*v = append(*v, value)
+	return nil
+}
+
+func loadHashKey(source string) ([]byte, error) {
+	if name, ok := strings.CutPrefix(source, "env:"); ok {
+		key, ok := os.LookupEnv(name)
+		if !ok || key == "" {
+			return nil, fmt.Errorf(`environment variable "%s" is not set`, name) //nolint:err113
+		}
+		return []byte(key), nil
+	} else if path, ok := strings.CutPrefix(source, "file:"); ok {
+		key, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read key: %w", err)
+		}
+		// We remove trailing newline which is common in files.
+		key = bytes.TrimRight(key, "\r\n")
+		if len(key) == 0 {
+			return nil, fmt.Errorf(`file "%s" is empty`, path) //nolint:err113
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf(`expected env:VAR or file:path, got "%s"`, source) //nolint:err113
+}
+
+func loadUserAgentRules(path string) (*regex2json.UserAgentRules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open user agent rules: %w", err)
+	}
+	defer f.Close()
+	return regex2json.LoadUserAgentRules(f) //nolint:wrapcheck
+}
+
+// newEncoder returns a function which creates record encoders for the format.
+func newEncoder(format, columns string) (func(w io.Writer) regex2json.RecordEncoder, error) {
+	var cols []string
+	if columns != "" {
+		cols = strings.Split(columns, ",")
+	}
+	switch format {
+	case "json":
+		return regex2json.NewJSONEncoder, nil
+	case "pretty":
+		return regex2json.NewPrettyJSONEncoder, nil
+	case "yaml":
+		return regex2json.NewYAMLEncoder, nil
+	case "logfmt":
+		return regex2json.NewLogfmtEncoder, nil
+	case "csv", "tsv":
+		comma := ','
+		if format == "tsv" {
+			comma = '\t'
+		}
+		return func(w io.Writer) regex2json.RecordEncoder {
+			return regex2json.NewCSVEncoder(w, comma, cols)
+		}, nil
+	}
+	return nil, fmt.Errorf(`unknown format "%s"`, format) //nolint:err113
+}
+
+// expandInputs expands globs in inputs. Inputs which do not match
+// any file are kept as they are and "-" is kept for stdin.
+func expandInputs(inputs []string, warnLogger *log.Logger) []string {
+	res := []string{}
+	for _, input := range inputs {
+		if input == "-" {
+			res = append(res, input)
+			continue
+		}
+		matches, err := filepath.Glob(input)
+		if err != nil {
+			warnLogger.Printf(`invalid glob "%s": %s`, input, err)
+			continue
+		}
+		if len(matches) == 0 {
+			res = append(res, input)
+			continue
+		}
+		res = append(res, matches...)
+	}
+	return res
+}
+
+// transformInput transforms lines from the input file, or stdin if input is "-".
+// Files are decompressed based on their magic bytes, stdin using stdinCompression.
+// Errors opening the file are returned as regex2json.ErrReadingInput errors.
+func transformInput(
+	transformer *regex2json.CompiledTransformer, input string, stdinCompression regex2json.Compression,
+	encoder regex2json.RecordEncoder, unmatched io.Writer, unmatchedEncoder regex2json.RecordEncoder,
+) error {
+	var in io.Reader = os.Stdin
+	compression := stdinCompression
+	if input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			return fmt.Errorf("%w: %w", regex2json.ErrReadingInput, err)
+		}
+		defer f.Close()
+		in = f
+		compression = regex2json.CompressionAuto
+	}
+	r, err := regex2json.Decompress(in, compression)
+	if err != nil {
+		return fmt.Errorf("%s: %w", input, err)
+	}
+	defer r.Close()
+	return transformer.TransformWith(r, encoder, unmatched, unmatchedEncoder) //nolint:wrapcheck
+}
+
+// transformFollower transforms lines from the followed file until following is stopped.
+// Every file read by the follower is transformed separately, so that offsets and line
+// numbers are those in the file the line has been read from.
+func transformFollower(
+	transformer *regex2json.CompiledTransformer, f *follower,
+	encoder regex2json.RecordEncoder, unmatched io.Writer, unmatchedEncoder regex2json.RecordEncoder,
+) error {
+	for {
+		err := transformer.TransformWith(f, encoder, unmatched, unmatchedEncoder)
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+		if !f.Next() {
+			return nil
+		}
+	}
+}
+
 func main() {
 	errorLogger := log.New(os.Stderr, "error: ", 0)
 	warnLogger := log.New(os.Stderr, "warning: ", 0)
 
-	if len(os.Args) != 2 { //nolint:mnd
-		errorLogger.Printf("invalid number of arguments, got %d, expected 1", len(os.Args)-1)
+	var aliases keyValues
+	var mergeStrategy regex2json.MergeStrategy
+	var errorsKey string
+	var unmatchedKey string
+	var unmatchedFlagKey string
+	var unmatchedOutput string
+	var metadataKeys regex2json.MetadataKeys
+	var stdinCompression regex2json.Compression
+	var inputEncoding string
+	var invalidUTF8 regex2json.UTF8Policy
+	var orderFields bool
+	var fieldOrder string
+	var format string
+	var columns string
+	var output string
+	var rotateSize int64
+	var rotateInterval time.Duration
+	var retain int
+	var compressRotated bool
+	var follow bool
+	var stateFile string
+	var patterns keyValues
+	var networks keyValues
+	var geoIPs values
+	var hashKeys keyValues
+	var userAgentRules string
+
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [flags] <regexp> [file ...]\n\nFlags:\n", flags.Name())
+		flags.PrintDefaults()
+	}
+	flags.Var(&aliases, "alias", "expression used instead of capture group's name, as `name=expression`; can be repeated")
+	flags.TextVar(&mergeStrategy, "merge", regex2json.MergeError, "merge `strategy` for conflicting values: error, first, last, or collect")
+	flags.StringVar(&errorsKey, "errors-key", "", "add errors applying expressions to output JSON under this `key` instead of logging them")
+	flags.StringVar(&unmatchedKey, "unmatched-key", "", "write unmatched lines as JSON with the line under this `key` to stdout instead of raw to stderr")
+	flags.StringVar(&unmatchedFlagKey, "unmatched-flag-key", "_unmatched", "`key` set to true in JSON for unmatched lines")
+	flags.StringVar(&unmatchedOutput, "unmatched-output", "", "file to which unmatched lines are appended instead, as `path`")
+	flags.StringVar(&metadataKeys.Line, "line-key", "", "add line number to output JSON under this `key`")
+	flags.StringVar(&metadataKeys.Offset, "offset-key", "", "add byte offset of the line to output JSON under this `key`")
+	flags.StringVar(&metadataKeys.Source, "source-key", "", "add name of the input file to output JSON under this `key`")
+	flags.StringVar(&metadataKeys.Time, "time-key", "", "add time when the line was read to output JSON under this `key`")
+	flags.StringVar(&metadataKeys.Raw, "raw-key", "", "add raw line to output JSON under this `key`")
+	flags.StringVar(&metadataKeys.Regexp, "regexp-key", "", "add regexp which matched the line to output JSON under this `key`")
+	flags.TextVar(&stdinCompression, "decompress", regex2json.CompressionAuto, "`compression` of stdin: auto, none, gzip, bzip2, zstd, or xz")
+	flags.BoolVar(&orderFields, "order-fields", false, "encode fields in the order of capture groups instead of alphabetically")
+	flags.StringVar(&fieldOrder, "field-order", "", "order of fields, with nested keys joined with a dot and _xHH_ escapes, as `field[,field...]`")
+	flags.StringVar(&format, "format", "json", "output `format`: json, pretty, csv, tsv, logfmt, or yaml")
+	flags.StringVar(&columns, "columns", "", "columns for csv and tsv formats, with nested keys joined with a dot, as `column[,column...]` (required with -unmatched-key)")
+	flags.StringVar(&output, "output", "", "file to which output is appended instead of stdout, as `path`")
+	flags.Int64Var(&rotateSize, "rotate-size", 0, "rotate output file when it would exceed this `size` in bytes")
+	flags.DurationVar(&rotateInterval, "rotate-interval", 0, "rotate output file every `duration`")
+	flags.IntVar(&retain, "retain", 0, "keep only this `count` of rotated output files")
+	flags.BoolVar(&compressRotated, "compress-rotated", false, "compress rotated output files with gzip")
+	flags.StringVar(&inputEncoding, "input-encoding", "", "character `encoding` of input (e.g., ISO-8859-1, windows-1252, UTF-16LE), decoded into UTF-8")
+	flags.TextVar(&invalidUTF8, "invalid-utf8", regex2json.UTF8Keep, "`policy` for lines with invalid UTF-8: keep, replace, escape, or unmatched")
+	flags.BoolVar(&follow, "follow", false, "keep reading data appended to the file, reopening it when it is rotated or truncated")
+	flags.StringVar(&stateFile, "state-file", "", "file in which to persist the read offset when following, to resume from it, as `path`")
+	flags.Var(&patterns, "pattern", "named regexp available to the regex operator, as `name=regexp`; can be repeated")
+	flags.Var(&networks, "network", "named network ranges available to the cidr operator, as `name=cidr[,cidr...]`; can be repeated")
+	flags.Var(&geoIPs, "geoip", "local MaxMind database (.mmdb) available to the geoip operator, as `path`; can be repeated")
+	flags.Var(&hashKeys, "hash-key", "named key available to the hash operator, read from an environment variable or a file, as `name=env:VAR|file:path`; can be repeated")
+	flags.StringVar(&userAgentRules, "useragent-rules", "", "JSON file with rules used by the useragent operator instead of embedded rules, as `path`")
+	_ = flags.Parse(os.Args[1:])
+
+	if flags.NArg() < 1 {
+		errorLogger.Printf("invalid number of arguments, got %d, expected at least 1", flags.NArg())
 		os.Exit(exitFailure)
 	}
 
-	r, err := regexp.Compile(os.Args[1])
+	for _, pattern := range patterns {
+		p, err := regexp.Compile(pattern[1])
+		if err != nil {
+			errorLogger.Printf(`invalid regexp for pattern "%s": %s`, pattern[0], err)
+			os.Exit(exitFailure)
+		}
+		regex2json.Patterns[pattern[0]] = p
+	}
+
+	for _, network := range networks {
+		prefixes, err := regex2json.ParseNetworks(network[1])
+		if err != nil {
+			errorLogger.Printf(`invalid network "%s": %s`, network[0], err)
+			os.Exit(exitFailure)
+		}
+		regex2json.Networks[network[0]] = append(regex2json.Networks[network[0]], prefixes...)
+	}
+
+	for _, path := range geoIPs {
+		database, err := regex2json.OpenGeoIPDatabase(path)
+		if err != nil {
+			errorLogger.Printf("%s", err)
+			os.Exit(exitFailure)
+		}
+		regex2json.GeoIPDatabases = append(regex2json.GeoIPDatabases, database)
+	}
+
+	for _, hashKey := range hashKeys {
+		key, err := loadHashKey(hashKey[1])
+		if err != nil {
+			errorLogger.Printf(`invalid hash key "%s": %s`, hashKey[0], err)
+			os.Exit(exitFailure)
+		}
+		regex2json.HashKeys[hashKey[0]] = key
+	}
+
+	if userAgentRules != "" {
+		rules, err := loadUserAgentRules(userAgentRules)
+		if err != nil {
+			errorLogger.Printf("%s", err)
+			os.Exit(exitFailure)
+		}
+		regex2json.UserAgent = rules
+	}
+
+	r, err := regexp.Compile(flags.Arg(0))
 	if err != nil {
 		errorLogger.Printf("invalid regexp: %s", err)
 		os.Exit(exitFailure)
 	}
 
-	err = regex2json.Transform(r, os.Stdin, os.Stdout, os.Stderr, warnLogger)
+	transformer := &regex2json.Transformer{
+		Regexp:           r,
+		Aliases:          map[string]string{},
+		MergeStrategy:    mergeStrategy,
+		ErrorsKey:        errorsKey,
+		UnmatchedKey:     unmatchedKey,
+		UnmatchedFlagKey: unmatchedFlagKey,
+		Encoding:         nil,
+		InvalidUTF8:      invalidUTF8,
+		MetadataKeys:     metadataKeys,
+		OrderFields:      orderFields,
+		FieldOrder:       nil,
+		Encoder:          nil,
+		Logger:           warnLogger,
+	}
+	if fieldOrder != "" {
+		transformer.FieldOrder = regex2json.ParseFieldOrder(fieldOrder)
+	}
+	transformer.Encoder, err = newEncoder(format, columns)
 	if err != nil {
 		errorLogger.Printf("%s", err)
 		os.Exit(exitFailure)
 	}
+	if unmatchedKey != "" && (format == "csv" || format == "tsv") && columns == "" {
+		// Otherwise columns would be determined from whichever line comes first.
+		errorLogger.Printf("unmatched key with %s format requires columns", format)
+		os.Exit(exitFailure)
+	}
+	if inputEncoding != "" {
+		transformer.Encoding, err = regex2json.ParseEncoding(inputEncoding)
+		if err != nil {
+			errorLogger.Printf("%s", err)
+			os.Exit(exitFailure)
+		}
+	}
+	for _, alias := range aliases {
+		transformer.Aliases[alias[0]] = alias[1]
+	}
+
+	// exit waits for the output to be closed (and rotated outputs compressed) before exiting.
+	exit := func(code int) {
+		os.Exit(code)
+	}
+
+	var matched io.Writer = os.Stdout
+	if output != "" {
+		w, err := newRotatingWriter(output, rotateSize, rotateInterval, retain, compressRotated, warnLogger)
+		if err != nil {
+			errorLogger.Printf("%s", err)
+			os.Exit(exitFailure)
+		}
+		matched = w
+		exit = func(code int) {
+			err := w.Close()
+			if err != nil {
+				errorLogger.Printf("unable to close output: %s", err)
+			}
+			os.Exit(code)
+		}
+
+		// On SIGHUP we reopen the output file, e.g., after it has been rotated by an external tool.
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				err := w.Reopen()
+				if err != nil {
+					warnLogger.Printf("unable to reopen output: %s", err)
+				}
+			}
+		}()
+	}
+
+	var unmatched io.Writer = os.Stderr
+	if unmatchedOutput != "" {
+		f, err := os.OpenFile(unmatchedOutput, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644) //nolint:mnd
+		if err != nil {
+			errorLogger.Printf("%s", err)
+			exit(exitFailure)
+		}
+		// File is closed when the program exits.
+		unmatched = f
+	} else if unmatchedKey != "" {
+		unmatched = matched
+	}
+
+	// Encoders are created once per output so that they are shared between all inputs
+	// (e.g., the CSV header is written only once).
+	encoder := transformer.Encoder(matched)
+	unmatchedEncoder := encoder
+	if unmatched != matched {
+		unmatchedEncoder = transformer.Encoder(unmatched)
+	}
+
+	compiled, err := transformer.Compile()
+	if err != nil {
+		errorLogger.Printf("%s", err)
+		exit(exitFailure)
+	}
+
+	inputs := flags.Args()[1:]
+
+	if follow {
+		if len(inputs) != 1 || inputs[0] == "-" {
+			errorLogger.Printf("follow requires exactly one file")
+			exit(exitFailure)
+		}
+		f, err := newFollower(inputs[0], stateFile, warnLogger)
+		if err != nil {
+			errorLogger.Printf("%s", err)
+			exit(exitFailure)
+		}
+		// On SIGINT and SIGTERM we stop following, so that the state is saved
+		// after lines which have been read are processed.
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-stop
+			// Another signal terminates the program immediately.
+			signal.Stop(stop)
+			f.Stop()
+		}()
+		err = transformFollower(compiled, f, encoder, unmatched, unmatchedEncoder)
+		f.Close()
+		if err != nil {
+			errorLogger.Printf("%s", err)
+			exit(exitFailure)
+		}
+		exit(exitSuccess)
+	} else if stateFile != "" {
+		errorLogger.Printf("state file can be used only with follow")
+		exit(exitFailure)
+	}
+
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+
+	// We continue with other inputs if reading an input fails, but exit with failure at the end.
+	code := exitSuccess
+	for _, input := range expandInputs(inputs, warnLogger) {
+		err := transformInput(compiled, input, stdinCompression, encoder, unmatched, unmatchedEncoder)
+		if errors.Is(err, bufio.ErrTooLong) {
+			// The rest of the input cannot be read, but other inputs can be.
+			warnLogger.Printf("%s: %s", input, err)
+			code = exitFailure
+			continue
+		} else if errors.Is(err, regex2json.ErrReadingInput) {
+			warnLogger.Printf("%s", err)
+			code = exitFailure
+			continue
+		} else if err != nil {
+			errorLogger.Printf("%s", err)
+			exit(exitFailure)
+		}
+	}
 
-	os.Exit(exitSuccess)
+	exit(code)
 }
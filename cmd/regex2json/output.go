@@ -0,0 +1,291 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const rotatedTimeFormat = "20060102T150405.000000000Z"
+
+// rotatingWriter writes to the file at path, rotating it when it reaches maxSize
+// bytes or every interval. Rotated files are renamed to path with a timestamp suffix,
+// optionally compressed with gzip, and only the last retain of them are kept.
+//
+// Rotated files are compressed in the background, so writes are not blocked by it.
+// Close waits for compression to finish.
+//
+// Every write is expected to be a complete line (which is true for writes done
+// by regex2json.Transformer), so files are rotated at line boundaries.
+//
+// It implements regex2json.HeaderWriter, writing the header at the start of every
+// new file.
+type rotatingWriter struct {
+	path     string
+	maxSize  int64
+	interval time.Duration
+	retain   int
+	compress bool
+	logger   *log.Logger
+
+	// Tracks compressions running in the background.
+	compressing sync.WaitGroup
+	// Compressions are done one at a time.
+	compressMu sync.Mutex
+
+	mu           sync.Mutex
+	header       []byte
+	file         *os.File
+	size         int64
+	nextRotation time.Time
+}
+
+func newRotatingWriter(path string, maxSize int64, interval time.Duration, retain int, compress bool, logger *log.Logger) (*rotatingWriter, error) {
+	w := &rotatingWriter{
+		path:         path,
+		maxSize:      maxSize,
+		interval:     interval,
+		retain:       retain,
+		compress:     compress,
+		logger:       logger,
+		compressing:  sync.WaitGroup{},
+		compressMu:   sync.Mutex{},
+		mu:           sync.Mutex{},
+		header:       nil,
+		file:         nil,
+		size:         0,
+		nextRotation: time.Time{},
+	}
+	err := w.open()
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotatingWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644) //nolint:mnd
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err //nolint:wrapcheck
+	}
+	w.file = file
+	w.size = info.Size()
+	if w.interval > 0 {
+		w.nextRotation = time.Now().Truncate(w.interval).Add(w.interval)
+	}
+	return w.writeHeader()
+}
+
+// writeHeader writes the header if the file is empty.
+func (w *rotatingWriter) writeHeader() error {
+	if len(w.header) == 0 || w.size > 0 {
+		return nil
+	}
+	n, err := w.file.Write(w.header)
+	w.size += int64(n)
+	return err //nolint:wrapcheck
+}
+
+// WriteHeader implements regex2json.HeaderWriter interface.
+func (w *rotatingWriter) WriteHeader(header []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.header = slices.Clone(header)
+	return w.writeHeader()
+}
+
+// Write implements io.Writer interface.
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// We do not rotate files with only the header.
+	empty := w.size <= int64(len(w.header))
+	sizeDue := w.maxSize > 0 && w.size+int64(len(p)) > w.maxSize
+	timeDue := w.interval > 0 && !time.Now().Before(w.nextRotation)
+	if (sizeDue || timeDue) && !empty {
+		err := w.rotate()
+		if err != nil {
+			return 0, err
+		}
+	} else if timeDue {
+		// We do not rotate empty files.
+		w.nextRotation = time.Now().Truncate(w.interval).Add(w.interval)
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err //nolint:wrapcheck
+}
+
+// Reopen closes and reopens the file at path, e.g., after it has been
+// rotated by an external tool.
+func (w *rotatingWriter) Reopen() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.file.Close()
+	if err != nil {
+		w.logger.Printf("unable to close output: %s", err)
+	}
+	return w.open()
+}
+
+// Close closes the file and waits for compression of rotated files to finish.
+func (w *rotatingWriter) Close() error {
+	w.mu.Lock()
+	err := w.file.Close()
+	w.mu.Unlock()
+
+	w.compressing.Wait()
+
+	return err //nolint:wrapcheck
+}
+
+func (w *rotatingWriter) rotate() error {
+	err := w.file.Close()
+	if err != nil {
+		w.logger.Printf("unable to close output: %s", err)
+	}
+
+	rotated, err := w.rotatedPath()
+	if err == nil {
+		err = os.Rename(w.path, rotated)
+	}
+	if err != nil {
+		// We continue writing to the same file.
+		w.logger.Printf("unable to rotate output: %s", err)
+		return w.open()
+	}
+
+	if w.compress {
+		w.compressing.Add(1)
+		go func() {
+			defer w.compressing.Done()
+			w.compressRotated(rotated)
+		}()
+	} else {
+		w.removeOld()
+	}
+
+	return w.open()
+}
+
+// compressRotated compresses the rotated file at path and removes old rotated files.
+func (w *rotatingWriter) compressRotated(path string) {
+	w.compressMu.Lock()
+	defer w.compressMu.Unlock()
+
+	err := compressFile(path)
+	if err == nil {
+		err = os.Remove(path)
+	}
+	if err != nil {
+		// We continue without compressing.
+		w.logger.Printf("unable to compress rotated output: %s", err)
+	}
+
+	// We remove old files only after compression so that the file being
+	// compressed and its compressed version are not counted twice.
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.removeOld()
+}
+
+// rotatedPath returns the path for the rotated file which does not yet exist.
+func (w *rotatingWriter) rotatedPath() (string, error) {
+	base := w.path + "." + time.Now().UTC().Format(rotatedTimeFormat)
+	for i := 0; ; i++ {
+		rotated := base
+		if i > 0 {
+			rotated += "." + strconv.Itoa(i)
+		}
+		exists := false
+		for _, p := range []string{rotated, rotated + ".gz"} {
+			_, err := os.Stat(p)
+			if err == nil {
+				exists = true
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return "", err //nolint:wrapcheck
+			}
+		}
+		if !exists {
+			return rotated, nil
+		}
+	}
+}
+
+// removeOld removes rotated files except the last retain of them.
+func (w *rotatingWriter) removeOld() {
+	if w.retain <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(escapeGlob(w.path) + ".[0-9]*T*Z*")
+	if err != nil {
+		w.logger.Printf("unable to list rotated outputs: %s", err)
+		return
+	}
+	// Timestamps in names sort chronologically.
+	slices.Sort(matches)
+	for len(matches) > w.retain {
+		err := os.Remove(matches[0])
+		if err != nil {
+			w.logger.Printf("unable to remove rotated output: %s", err)
+		}
+		matches = matches[1:]
+	}
+}
+
+// compressFile compresses the file at path into path with .gz suffix.
+func compressFile(path string) (errE error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644) //nolint:mnd
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	defer func() {
+		errE = errors.Join(errE, out.Close())
+		if errE != nil {
+			os.Remove(path + ".gz")
+		}
+	}()
+
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	return gz.Close() //nolint:wrapcheck
+}
+
+// escapeGlob escapes glob meta characters in path.
+func escapeGlob(path string) string {
+	res := make([]rune, 0, len(path))
+	for _, r := range path {
+		switch r {
+		case '*', '?', '[', '\\':
+			res = append(res, '\\')
+		}
+		res = append(res, r)
+	}
+	return string(res)
+}
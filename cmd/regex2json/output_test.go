@@ -0,0 +1,159 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rotatedFiles returns contents of rotated files for path, in order.
+func rotatedFiles(t *testing.T, path string) []string {
+	t.Helper()
+
+	matches, err := filepath.Glob(escapeGlob(path) + ".*")
+	require.NoError(t, err)
+	slices.Sort(matches)
+	res := []string{}
+	for _, match := range matches {
+		var r io.Reader
+		f, err := os.Open(match)
+		require.NoError(t, err)
+		r = f
+		if strings.HasSuffix(match, ".gz") {
+			r, err = gzip.NewReader(f)
+			require.NoError(t, err)
+		}
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		res = append(res, string(data))
+	}
+	return res
+}
+
+func writeLines(t *testing.T, w io.Writer, lines ...string) {
+	t.Helper()
+
+	for _, line := range lines {
+		_, err := w.Write([]byte(line + "\n"))
+		require.NoError(t, err)
+	}
+}
+
+func TestRotatingWriterSize(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "output.log")
+	w, err := newRotatingWriter(path, 10, 0, 0, false, log.New(io.Discard, "", 0))
+	require.NoError(t, err)
+
+	writeLines(t, w, "aaaa", "bbbb", "cccc", "dddddddddddd", "eeee")
+	require.NoError(t, w.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "eeee\n", string(data))
+	// Lines longer than the size are written to their own file.
+	assert.Equal(t, []string{"aaaa\nbbbb\n", "cccc\n", "dddddddddddd\n"}, rotatedFiles(t, path))
+}
+
+func TestRotatingWriterInterval(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "output.log")
+	w, err := newRotatingWriter(path, 0, 50*time.Millisecond, 0, false, log.New(io.Discard, "", 0))
+	require.NoError(t, err)
+
+	writeLines(t, w, "aaaa")
+	time.Sleep(100 * time.Millisecond)
+	writeLines(t, w, "bbbb")
+	require.NoError(t, w.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "bbbb\n", string(data))
+	assert.Equal(t, []string{"aaaa\n"}, rotatedFiles(t, path))
+}
+
+func TestRotatingWriterRetain(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "output.log")
+	w, err := newRotatingWriter(path, 1, 0, 2, false, log.New(io.Discard, "", 0))
+	require.NoError(t, err)
+
+	writeLines(t, w, "a", "b", "c", "d", "e")
+	require.NoError(t, w.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "e\n", string(data))
+	assert.Equal(t, []string{"c\n", "d\n"}, rotatedFiles(t, path))
+}
+
+func TestRotatingWriterCompress(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "output[1].log")
+	w, err := newRotatingWriter(path, 1, 0, 2, true, log.New(io.Discard, "", 0))
+	require.NoError(t, err)
+
+	writeLines(t, w, "a", "b", "c", "d")
+	// Close waits for compression to finish.
+	require.NoError(t, w.Close())
+
+	matches, err := filepath.Glob(escapeGlob(path) + ".*")
+	require.NoError(t, err)
+	require.Len(t, matches, 2)
+	for _, match := range matches {
+		assert.True(t, strings.HasSuffix(match, ".gz"), match)
+	}
+	assert.Equal(t, []string{"b\n", "c\n"}, rotatedFiles(t, path))
+}
+
+func TestRotatingWriterHeader(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "output.csv")
+	w, err := newRotatingWriter(path, 8, 0, 0, false, log.New(io.Discard, "", 0))
+	require.NoError(t, err)
+
+	err = w.WriteHeader([]byte("k,v\n"))
+	require.NoError(t, err)
+	writeLines(t, w, "a,1", "b,2")
+	require.NoError(t, w.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "k,v\nb,2\n", string(data))
+	assert.Equal(t, []string{"k,v\na,1\n"}, rotatedFiles(t, path))
+}
+
+func TestEscapeGlob(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		path     string
+		expected string
+	}{
+		{"output.log", "output.log"},
+		{"out*put?.log", `out\*put\?.log`},
+		{"output[1].log", `output\[1].log`},
+		{`dir\output.log`, `dir\\output.log`},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, tt.expected, escapeGlob(tt.path))
+		})
+	}
+}
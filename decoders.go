@@ -0,0 +1,166 @@
+package regex2json
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"unicode/utf8"
+)
+
+type invalidUTF8Fallback int
+
+const (
+	invalidUTF8Error invalidUTF8Fallback = iota
+	invalidUTF8Replace
+	invalidUTF8Keep
+)
+
+// parseInvalidUTF8Arg returns true if arg is an argument controlling
+// what happens with decoded strings which are not valid UTF-8.
+func parseInvalidUTF8Arg(arg string, fallback *invalidUTF8Fallback) bool {
+	switch arg {
+	case "replace":
+		*fallback = invalidUTF8Replace
+	case "keep":
+		*fallback = invalidUTF8Keep
+	default:
+		return false
+	}
+	return true
+}
+
+func decodedToString(in string, decoded []byte, fallback invalidUTF8Fallback) (string, error) {
+	if utf8.Valid(decoded) {
+		return string(decoded), nil
+	}
+	switch fallback {
+	case invalidUTF8Replace:
+		return string([]rune(string(decoded))), nil
+	case invalidUTF8Keep:
+		return in, nil
+	case invalidUTF8Error:
+	}
+	return "", fmt.Errorf(`%w: decoded "%s" is not valid UTF-8`, ErrInvalidValue, in)
+}
+
+// Base64Operator returns the base64 operator which decodes the input string
+// using base64 encoding into a string.
+//
+// It accepts any of the following optional arguments:
+//
+//   - std or url, for the standard or URL-safe alphabet (default std)
+//   - padded or raw, for padded or unpadded input (default padded)
+//   - replace or keep, when decoded string is not valid UTF-8,
+//     to replace invalid bytes with U+FFFD or to keep the input string
+//     unchanged (default is to error)
+func Base64Operator(args ...string) (Op, error) {
+	urlAlphabet := false
+	raw := false
+	fallback := invalidUTF8Error
+	for _, arg := range args {
+		switch arg {
+		case "std":
+			urlAlphabet = false
+		case "url":
+			urlAlphabet = true
+		case "padded":
+			raw = false
+		case "raw":
+			raw = true
+		default:
+			if !parseInvalidUTF8Arg(arg, &fallback) {
+				return nil, fmt.Errorf("%w: %s", ErrUnexpectedArgument, arg)
+			}
+		}
+	}
+	var encoding *base64.Encoding
+	switch {
+	case urlAlphabet && raw:
+		encoding = base64.RawURLEncoding
+	case urlAlphabet:
+		encoding = base64.URLEncoding
+	case raw:
+		encoding = base64.RawStdEncoding
+	default:
+		encoding = base64.StdEncoding
+	}
+	return func(in any) (any, error) {
+		s, skip, err := toStringOrSkip(in)
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			return in, nil
+		}
+		decoded, err := encoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf(`%w: unable to decode "%s" from base64: %w`, ErrInvalidValue, s, err)
+		}
+		return decodedToString(s, decoded, fallback)
+	}, nil
+}
+
+// HexOperator returns the hex operator which decodes the input string
+// using hexadecimal encoding into a string.
+//
+// It accepts one optional argument, replace or keep, when decoded string is
+// not valid UTF-8, to replace invalid bytes with U+FFFD or to keep the input
+// string unchanged (default is to error).
+func HexOperator(args ...string) (Op, error) {
+	fallback := invalidUTF8Error
+	for _, arg := range args {
+		if !parseInvalidUTF8Arg(arg, &fallback) {
+			return nil, fmt.Errorf("%w: %s", ErrUnexpectedArgument, arg)
+		}
+	}
+	return func(in any) (any, error) {
+		s, skip, err := toStringOrSkip(in)
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			return in, nil
+		}
+		decoded, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf(`%w: unable to decode "%s" from hex: %w`, ErrInvalidValue, s, err)
+		}
+		return decodedToString(s, decoded, fallback)
+	}, nil
+}
+
+// URLDecodeOperator returns the urldecode operator which decodes percent-encoded
+// input string using [url.QueryUnescape] (+ is decoded into a space).
+//
+// It accepts any of the following optional arguments:
+//
+//   - path, to use [url.PathUnescape] instead (+ is kept as-is)
+//   - replace or keep, when decoded string is not valid UTF-8,
+//     to replace invalid bytes with U+FFFD or to keep the input string
+//     unchanged (default is to error)
+func URLDecodeOperator(args ...string) (Op, error) {
+	unescape := url.QueryUnescape
+	fallback := invalidUTF8Error
+	for _, arg := range args {
+		if arg == "path" {
+			unescape = url.PathUnescape
+		} else if !parseInvalidUTF8Arg(arg, &fallback) {
+			return nil, fmt.Errorf("%w: %s", ErrUnexpectedArgument, arg)
+		}
+	}
+	return func(in any) (any, error) {
+		s, skip, err := toStringOrSkip(in)
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			return in, nil
+		}
+		decoded, err := unescape(s)
+		if err != nil {
+			return nil, fmt.Errorf(`%w: unable to decode "%s" from percent-encoding: %w`, ErrInvalidValue, s, err)
+		}
+		return decodedToString(s, []byte(decoded), fallback)
+	}, nil
+}
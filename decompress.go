@@ -0,0 +1,216 @@
+package regex2json
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression determines how is input decompressed.
+type Compression int
+
+const (
+	// CompressionAuto detects compression from magic bytes at the start of the input,
+	// reading the input as-is if no known compression is detected.
+	CompressionAuto Compression = iota
+	// CompressionNone reads the input as-is.
+	CompressionNone
+	// CompressionGzip decompresses gzip input.
+	CompressionGzip
+	// CompressionBzip2 decompresses bzip2 input.
+	CompressionBzip2
+	// CompressionZstd decompresses zstd input.
+	CompressionZstd
+	// CompressionXz decompresses xz input.
+	CompressionXz
+)
+
+var compressionNames = map[Compression]string{ //nolint:gochecknoglobals
+	CompressionAuto:  "auto",
+	CompressionNone:  "none",
+	CompressionGzip:  "gzip",
+	CompressionBzip2: "bzip2",
+	CompressionZstd:  "zstd",
+	CompressionXz:    "xz",
+}
+
+type compressionMagic struct {
+	compression Compression
+	magic       []byte
+	// If set, the byte after magic bytes must be one of these bytes.
+	next []byte
+}
+
+var compressionMagics = []compressionMagic{ //nolint:gochecknoglobals
+	{CompressionGzip, []byte{0x1f, 0x8b}, nil},
+	// Magic bytes are followed by the block size, from 1 to 9.
+	{CompressionBzip2, []byte("BZh"), []byte("123456789")},
+	{CompressionZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}, nil},
+	{CompressionXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, nil},
+}
+
+// match returns true if data starts with magic bytes. It returns short if data
+// is a prefix of magic bytes and more data is needed to tell.
+func (m compressionMagic) match(data []byte) (bool, bool) {
+	magic := m.magic
+	if len(data) < len(magic) {
+		return false, bytes.HasPrefix(magic, data)
+	}
+	if !bytes.HasPrefix(data, magic) {
+		return false, false
+	}
+	if m.next == nil {
+		return true, false
+	}
+	if len(data) == len(magic) {
+		return false, true
+	}
+	return bytes.IndexByte(m.next, data[len(magic)]) >= 0, false
+}
+
+// detectCompression detects compression from magic bytes at the start of br.
+//
+// It waits only for the first read and then checks data which is already buffered,
+// so that it does not block on a pipe (e.g., stdin) waiting for more data to come.
+// Only if buffered data is too short to tell, it waits for more.
+func detectCompression(br *bufio.Reader) Compression {
+	_, err := br.Peek(1)
+	for err == nil {
+		data, _ := br.Peek(br.Buffered())
+		short := false
+		for _, m := range compressionMagics {
+			matched, s := m.match(data)
+			if matched {
+				return m.compression
+			}
+			short = short || s
+		}
+		if !short {
+			break
+		}
+		// Peek returns an error if there is less data than requested
+		// (e.g., at the end of input), which means that no magic bytes match.
+		_, err = br.Peek(len(data) + 1)
+	}
+	return CompressionNone
+}
+
+// ParseCompression parses the name of the compression.
+func ParseCompression(name string) (Compression, error) {
+	for compression, n := range compressionNames {
+		if n == name {
+			return compression, nil
+		}
+	}
+	return CompressionAuto, fmt.Errorf("%w: unknown compression: %s", ErrInvalidValue, name)
+}
+
+// String returns the name of the compression.
+func (c Compression) String() string {
+	if name, ok := compressionNames[c]; ok {
+		return name
+	}
+	return "Compression(" + strconv.Itoa(int(c)) + ")"
+}
+
+// MarshalText implements [encoding.TextMarshaler] interface.
+func (c Compression) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText implements [encoding.TextUnmarshaler] interface.
+func (c *Compression) UnmarshalText(text []byte) error {
+	compression, err := ParseCompression(string(text))
+	if err != nil {
+		return err
+	}
+	*c = compression
+	return nil
+}
+
+type decompressReader struct {
+	io.Reader
+	close func() error
+}
+
+func (d *decompressReader) Close() error {
+	if d.close != nil {
+		return d.close()
+	}
+	return nil
+}
+
+type namedDecompressReader struct {
+	decompressReader
+	name string
+}
+
+// Name returns the name of the underlying reader.
+func (n *namedDecompressReader) Name() string {
+	return n.name
+}
+
+// Decompress returns a reader which decompresses r using compression.
+// With [CompressionAuto] compression is detected from magic bytes.
+//
+// If r has a Name method (e.g., [os.File]), so does the returned reader,
+// so that [Transformer] can use it for source metadata.
+//
+// Closing the returned reader does not close r.
+func Decompress(r io.Reader, compression Compression) (io.ReadCloser, error) {
+	d, err := decompress(r, compression)
+	if err != nil {
+		return nil, err
+	}
+	if n, ok := r.(interface{ Name() string }); ok {
+		return &namedDecompressReader{
+			decompressReader: *d,
+			name:             n.Name(),
+		}, nil
+	}
+	return d, nil
+}
+
+func decompress(r io.Reader, compression Compression) (*decompressReader, error) {
+	if compression == CompressionAuto {
+		br := bufio.NewReader(r)
+		compression = detectCompression(br)
+		r = br
+	}
+
+	switch compression {
+	case CompressionAuto, CompressionNone:
+		return &decompressReader{Reader: r, close: nil}, nil
+	case CompressionGzip:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: gzip: %w", ErrReadingInput, err)
+		}
+		return &decompressReader{Reader: gr, close: gr.Close}, nil
+	case CompressionBzip2:
+		return &decompressReader{Reader: bzip2.NewReader(r), close: nil}, nil
+	case CompressionZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: zstd: %w", ErrReadingInput, err)
+		}
+		return &decompressReader{Reader: zr, close: func() error {
+			zr.Close()
+			return nil
+		}}, nil
+	case CompressionXz:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: xz: %w", ErrReadingInput, err)
+		}
+		return &decompressReader{Reader: xr, close: nil}, nil
+	}
+	return nil, fmt.Errorf("%w: unknown compression: %s", ErrInvalidValue, compression)
+}
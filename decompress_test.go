@@ -0,0 +1,180 @@
+package regex2json_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+
+	"gitlab.com/tozd/regex2json"
+)
+
+const testDecompressInput = "foo\nbar\n"
+
+func compressGzip(t *testing.T) []byte {
+	t.Helper()
+
+	buf := bytes.Buffer{}
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write([]byte(testDecompressInput))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func compressZstd(t *testing.T) []byte {
+	t.Helper()
+
+	buf := bytes.Buffer{}
+	w, err := zstd.NewWriter(&buf)
+	require.NoError(t, err)
+	_, err = w.Write([]byte(testDecompressInput))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func compressXz(t *testing.T) []byte {
+	t.Helper()
+
+	buf := bytes.Buffer{}
+	w, err := xz.NewWriter(&buf)
+	require.NoError(t, err)
+	_, err = w.Write([]byte(testDecompressInput))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func compressBzip2(t *testing.T) []byte {
+	t.Helper()
+
+	// There is no bzip2 compressor in the standard library.
+	data, err := hex.DecodeString("425a6839314159265359abf8618b0000024180001031009000200030c00861a52ce8185dc914e14242afe1862c")
+	require.NoError(t, err)
+	return data
+}
+
+func TestDecompress(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		compression regex2json.Compression
+		compress    func(t *testing.T) []byte
+	}{
+		{regex2json.CompressionNone, func(*testing.T) []byte { return []byte(testDecompressInput) }},
+		{regex2json.CompressionGzip, compressGzip},
+		{regex2json.CompressionBzip2, compressBzip2},
+		{regex2json.CompressionZstd, compressZstd},
+		{regex2json.CompressionXz, compressXz},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.compression.String(), func(t *testing.T) {
+			t.Parallel()
+
+			data := tt.compress(t)
+
+			for _, compression := range []regex2json.Compression{regex2json.CompressionAuto, tt.compression} {
+				r, err := regex2json.Decompress(bytes.NewReader(data), compression)
+				require.NoError(t, err)
+				out, err := io.ReadAll(r)
+				require.NoError(t, err)
+				assert.Equal(t, testDecompressInput, string(out))
+				require.NoError(t, r.Close())
+			}
+		})
+	}
+}
+
+func TestDecompressEmpty(t *testing.T) {
+	t.Parallel()
+
+	r, err := regex2json.Decompress(bytes.NewReader(nil), regex2json.CompressionAuto)
+	require.NoError(t, err)
+	out, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Empty(t, out)
+}
+
+func TestDecompressNotCompressed(t *testing.T) {
+	t.Parallel()
+
+	for _, input := range []string{"BZhello\n", "BZh", "BZ", "\x1f"} {
+		r, err := regex2json.Decompress(bytes.NewReader([]byte(input)), regex2json.CompressionAuto)
+		require.NoError(t, err)
+		out, err := io.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, input, string(out))
+	}
+}
+
+func TestDecompressPipe(t *testing.T) {
+	t.Parallel()
+
+	// Detection does not wait for more data than available.
+	pr, pw := io.Pipe()
+	t.Cleanup(func() {
+		pw.Close()
+	})
+	go func() {
+		_, _ = pw.Write([]byte("foo\n"))
+	}()
+	r, err := regex2json.Decompress(pr, regex2json.CompressionAuto)
+	require.NoError(t, err)
+	out := make([]byte, 4)
+	_, err = io.ReadFull(r, out)
+	require.NoError(t, err)
+	assert.Equal(t, "foo\n", string(out))
+
+	// Detection waits for more data if available data is a prefix of magic bytes.
+	data := compressGzip(t)
+	pr, pw = io.Pipe()
+	go func() {
+		_, _ = pw.Write(data[:1])
+		_, _ = pw.Write(data[1:])
+		pw.Close()
+	}()
+	r, err = regex2json.Decompress(pr, regex2json.CompressionAuto)
+	require.NoError(t, err)
+	all, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, testDecompressInput, string(all))
+}
+
+func TestDecompressErrors(t *testing.T) {
+	t.Parallel()
+
+	_, err := regex2json.Decompress(bytes.NewReader([]byte(testDecompressInput)), regex2json.CompressionGzip)
+	assert.ErrorIs(t, err, regex2json.ErrReadingInput)
+
+	_, err = regex2json.ParseCompression("lz4")
+	assert.EqualError(t, err, "invalid value: unknown compression: lz4")
+}
+
+func TestDecompressName(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "input.log.gz")
+	err := os.WriteFile(path, compressGzip(t), 0o600)
+	require.NoError(t, err)
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		f.Close()
+	})
+
+	r, err := regex2json.Decompress(f, regex2json.CompressionAuto)
+	require.NoError(t, err)
+	n, ok := r.(interface{ Name() string })
+	require.True(t, ok)
+	assert.Equal(t, path, n.Name())
+}
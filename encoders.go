@@ -0,0 +1,362 @@
+package regex2json
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FlattenSeparator is used to join keys of nested objects when flattening records
+// for formats which do not support nesting (CSV, TSV, logfmt).
+const FlattenSeparator = "."
+
+// RecordEncoder encodes records (output JSON objects) and writes them out.
+//
+// Fields of the record are encoded in the order determined by order,
+// which can be nil to sort all fields alphabetically.
+//
+// Every record should be written with one call to the underlying writer,
+// so that records from multiple encoders writing to the same writer do not interleave.
+type RecordEncoder interface {
+	Encode(record map[string]any, order *FieldOrder) error
+}
+
+// HeaderWriter is implemented by writers which write to multiple files (e.g., when
+// rotating them) and so need the header of the format at the start of every file.
+type HeaderWriter interface {
+	io.Writer
+
+	// WriteHeader sets the header which is written at the start of every new file.
+	// The header is written immediately if the current file is empty.
+	WriteHeader(header []byte) error
+}
+
+type jsonEncoder struct {
+	w      io.Writer
+	indent bool
+}
+
+// NewJSONEncoder returns a [RecordEncoder] which writes records as
+// newline-delimited JSON.
+func NewJSONEncoder(w io.Writer) RecordEncoder { //nolint:ireturn
+	return &jsonEncoder{w: w, indent: false}
+}
+
+// NewPrettyJSONEncoder returns a [RecordEncoder] which writes records as
+// indented JSON, one after the other.
+func NewPrettyJSONEncoder(w io.Writer) RecordEncoder { //nolint:ireturn
+	return &jsonEncoder{w: w, indent: true}
+}
+
+func (e *jsonEncoder) Encode(record map[string]any, order *FieldOrder) error {
+	buf := bytes.Buffer{}
+	err := appendJSON(&buf, record, order)
+	if err != nil {
+		return err
+	}
+	if e.indent {
+		indented := bytes.Buffer{}
+		err := json.Indent(&indented, buf.Bytes(), "", "  ")
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+		buf = indented
+	}
+	buf.WriteByte('\n')
+	_, err = e.w.Write(buf.Bytes())
+	return err //nolint:wrapcheck
+}
+
+// appendJSON appends value encoded as JSON to buf, with fields of objects
+// in order.
+func appendJSON(buf *bytes.Buffer, value any, order *FieldOrder) error {
+	switch v := value.(type) {
+	case map[string]any:
+		buf.WriteByte('{')
+		for i, key := range order.Keys(v) {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			err := appendJSON(buf, key, nil)
+			if err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			err = appendJSON(buf, v[key], order.Field(key))
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		return nil
+	case []any:
+		buf.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			err := appendJSON(buf, e, order)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+	}
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(value)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	// We remove the newline added by the encoder.
+	buf.Truncate(buf.Len() - 1)
+	return nil
+}
+
+type yamlEncoder struct {
+	w io.Writer
+}
+
+// NewYAMLEncoder returns a [RecordEncoder] which writes records as
+// a stream of YAML documents, each starting with ---.
+func NewYAMLEncoder(w io.Writer) RecordEncoder { //nolint:ireturn
+	return &yamlEncoder{w: w}
+}
+
+func (e *yamlEncoder) Encode(record map[string]any, order *FieldOrder) error {
+	node, err := toYAMLNode(record, order)
+	if err != nil {
+		return err
+	}
+	buf := bytes.Buffer{}
+	buf.WriteString("---\n")
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2) //nolint:mnd
+	err = encoder.Encode(node)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	err = encoder.Close()
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	_, err = e.w.Write(buf.Bytes())
+	return err //nolint:wrapcheck
+}
+
+// toYAMLNode converts value to a YAML node, with fields of objects in order.
+func toYAMLNode(value any, order *FieldOrder) (*yaml.Node, error) {
+	switch v := value.(type) {
+	case map[string]any:
+		node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"} //nolint:exhaustruct
+		for _, key := range order.Keys(v) {
+			k, err := toYAMLNode(key, nil)
+			if err != nil {
+				return nil, err
+			}
+			e, err := toYAMLNode(v[key], order.Field(key))
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, k, e)
+		}
+		return node, nil
+	case []any:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"} //nolint:exhaustruct
+		for _, e := range v {
+			n, err := toYAMLNode(e, order)
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, n)
+		}
+		return node, nil
+	}
+	node := &yaml.Node{} //nolint:exhaustruct
+	err := node.Encode(value)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	return node, nil
+}
+
+type csvEncoder struct {
+	w       io.Writer
+	comma   rune
+	columns []string
+	header  bool
+}
+
+// NewCSVEncoder returns a [RecordEncoder] which writes records as CSV rows,
+// using comma as the field delimiter (e.g., ',' for CSV or '\t' for TSV).
+// Before the first row, a header row with columns is written. If w implements
+// [HeaderWriter], the header row is passed to it instead.
+//
+// Records are flattened, with keys of nested objects joined with [FlattenSeparator].
+// Arrays are written as JSON. If columns are not provided, they are determined from
+// the first record (in order) and keys not present in the first record are not written.
+func NewCSVEncoder(w io.Writer, comma rune, columns []string) RecordEncoder { //nolint:ireturn
+	return &csvEncoder{w: w, comma: comma, columns: columns, header: false}
+}
+
+func (e *csvEncoder) Encode(record map[string]any, order *FieldOrder) error {
+	flat, keys := flatten(record, order)
+
+	if e.columns == nil {
+		e.columns = keys
+	}
+
+	buf := bytes.Buffer{}
+	writer := csv.NewWriter(&buf)
+	writer.Comma = e.comma
+	if !e.header {
+		err := writer.Write(e.columns)
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+		if hw, ok := e.w.(HeaderWriter); ok {
+			writer.Flush()
+			err = writer.Error()
+			if err != nil {
+				return err //nolint:wrapcheck
+			}
+			err = hw.WriteHeader(buf.Bytes())
+			if err != nil {
+				return err //nolint:wrapcheck
+			}
+			buf.Reset()
+		}
+		e.header = true
+	}
+	row := make([]string, len(e.columns))
+	for i, column := range e.columns {
+		value, err := formatValue(flat[column])
+		if err != nil {
+			return err
+		}
+		row[i] = value
+	}
+	err := writer.Write(row)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	writer.Flush()
+	err = writer.Error()
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	_, err = e.w.Write(buf.Bytes())
+	return err //nolint:wrapcheck
+}
+
+type logfmtEncoder struct {
+	w io.Writer
+}
+
+// NewLogfmtEncoder returns a [RecordEncoder] which writes records as logfmt lines
+// of key=value pairs.
+//
+// Records are flattened, with keys of nested objects joined with [FlattenSeparator].
+// Arrays are written as JSON. Values are quoted when needed.
+func NewLogfmtEncoder(w io.Writer) RecordEncoder { //nolint:ireturn
+	return &logfmtEncoder{w: w}
+}
+
+func (e *logfmtEncoder) Encode(record map[string]any, order *FieldOrder) error {
+	flat, keys := flatten(record, order)
+
+	buf := bytes.Buffer{}
+	for i, key := range keys {
+		value, err := formatValue(flat[key])
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(logfmtKey(key))
+		buf.WriteByte('=')
+		buf.WriteString(logfmtValue(value))
+	}
+	buf.WriteByte('\n')
+	_, err := e.w.Write(buf.Bytes())
+	return err //nolint:wrapcheck
+}
+
+// flatten flattens nested objects in record, joining their keys with [FlattenSeparator].
+// It returns flattened values and their keys in order.
+func flatten(record map[string]any, order *FieldOrder) (map[string]any, []string) {
+	values := map[string]any{}
+	keys := []string{}
+	var f func(prefix string, value any, order *FieldOrder)
+	f = func(prefix string, value any, order *FieldOrder) {
+		if object, ok := value.(map[string]any); ok && len(object) > 0 {
+			for _, key := range order.Keys(object) {
+				f(prefix+FlattenSeparator+key, object[key], order.Field(key))
+			}
+			return
+		}
+		values[prefix] = value
+		keys = append(keys, prefix)
+	}
+	for _, key := range order.Keys(record) {
+		f(key, record[key], order.Field(key))
+	}
+	return values, keys
+}
+
+// formatValue formats a flattened value as a string. Strings are returned as-is,
+// missing values and nulls are returned as an empty string, and other values are
+// formatted as JSON.
+func formatValue(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	}
+	buf := bytes.Buffer{}
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(value)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrUnexpectedType, err)
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// logfmtKey replaces characters which are not allowed in logfmt keys with _.
+func logfmtKey(key string) string {
+	if key == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '=' || r == '"' || r == utf8.RuneError {
+			return '_'
+		}
+		return r
+	}, key)
+}
+
+// logfmtValue quotes the value if it is empty or contains characters
+// which are not allowed in unquoted logfmt values.
+func logfmtValue(value string) string {
+	if value == "" {
+		return `""`
+	}
+	if strings.IndexFunc(value, func(r rune) bool {
+		return r <= ' ' || r == '=' || r == '"' || r == '\\' || !unicode.IsPrint(r)
+	}) >= 0 {
+		return strconv.Quote(value)
+	}
+	return value
+}
@@ -0,0 +1,152 @@
+package regex2json_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/tozd/regex2json"
+)
+
+func TestRecordEncoders(t *testing.T) {
+	t.Parallel()
+
+	records := []map[string]any{
+		{
+			"msg":    "hello world",
+			"status": int64(200),
+			"ok":     true,
+			"http":   map[string]any{"method": "GET", "path": "/a=b"},
+			"tags":   []any{"x", "y"},
+		},
+		{
+			"msg":    "",
+			"status": int64(404),
+			"extra":  nil,
+		},
+	}
+
+	tests := []struct {
+		name       string
+		newEncoder func(w io.Writer) regex2json.RecordEncoder
+		expected   string
+	}{
+		{
+			"json",
+			regex2json.NewJSONEncoder,
+			`{"http":{"method":"GET","path":"/a=b"},"msg":"hello world","ok":true,"status":200,"tags":["x","y"]}` + "\n" +
+				`{"extra":null,"msg":"","status":404}` + "\n",
+		},
+		{
+			"pretty",
+			regex2json.NewPrettyJSONEncoder,
+			"{\n  \"http\": {\n    \"method\": \"GET\",\n    \"path\": \"/a=b\"\n  },\n  \"msg\": \"hello world\",\n  \"ok\": true,\n  \"status\": 200,\n  \"tags\": [\n    \"x\",\n    \"y\"\n  ]\n}\n" +
+				"{\n  \"extra\": null,\n  \"msg\": \"\",\n  \"status\": 404\n}\n",
+		},
+		{
+			"yaml",
+			regex2json.NewYAMLEncoder,
+			"---\nhttp:\n  method: GET\n  path: /a=b\nmsg: hello world\nok: true\nstatus: 200\ntags:\n  - x\n  - \"y\"\n" +
+				"---\nextra: null\nmsg: \"\"\nstatus: 404\n",
+		},
+		{
+			"csv",
+			func(w io.Writer) regex2json.RecordEncoder {
+				return regex2json.NewCSVEncoder(w, ',', nil)
+			},
+			"http.method,http.path,msg,ok,status,tags\n" +
+				`GET,/a=b,hello world,true,200,"[""x"",""y""]"` + "\n" +
+				",,,,404,\n",
+		},
+		{
+			"tsv",
+			func(w io.Writer) regex2json.RecordEncoder {
+				return regex2json.NewCSVEncoder(w, '\t', []string{"status", "msg", "http.path"})
+			},
+			"status\tmsg\thttp.path\n" +
+				"200\thello world\t/a=b\n" +
+				"404\t\t\n",
+		},
+		{
+			"logfmt",
+			regex2json.NewLogfmtEncoder,
+			`http.method=GET http.path="/a=b" msg="hello world" ok=true status=200 tags="[\"x\",\"y\"]"` + "\n" +
+				`extra="" msg="" status=404` + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			out := bytes.Buffer{}
+			encoder := tt.newEncoder(&out)
+			for _, record := range records {
+				err := encoder.Encode(record, nil)
+				require.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected, out.String())
+		})
+	}
+}
+
+func TestRecordEncodersFieldOrder(t *testing.T) {
+	t.Parallel()
+
+	order := regex2json.ParseFieldOrder("z,items.b,nested.y")
+	record := map[string]any{
+		"a":      "1",
+		"z":      "2",
+		"items":  []any{map[string]any{"a": "3", "b": "4"}},
+		"nested": map[string]any{"x": "5", "y": "6"},
+	}
+
+	out := bytes.Buffer{}
+	err := regex2json.NewJSONEncoder(&out).Encode(record, order)
+	require.NoError(t, err)
+	assert.Equal(t, `{"z":"2","items":[{"b":"4","a":"3"}],"nested":{"y":"6","x":"5"},"a":"1"}`+"\n", out.String())
+
+	out.Reset()
+	err = regex2json.NewYAMLEncoder(&out).Encode(record, order)
+	require.NoError(t, err)
+	assert.Equal(t, "---\nz: \"2\"\nitems:\n  - b: \"4\"\n    a: \"3\"\nnested:\n  \"y\": \"6\"\n  x: \"5\"\na: \"1\"\n", out.String())
+
+	out.Reset()
+	err = regex2json.NewLogfmtEncoder(&out).Encode(record, order)
+	require.NoError(t, err)
+	assert.Equal(t, `z=2 items="[{\"a\":\"3\",\"b\":\"4\"}]" nested.y=6 nested.x=5 a=1`+"\n", out.String())
+
+	// Keys containing separators can be escaped.
+	order = regex2json.ParseFieldOrder("b_x2c_c,a_x2e_b,a.c")
+	out.Reset()
+	err = regex2json.NewJSONEncoder(&out).Encode(map[string]any{"a": map[string]any{"b": "1", "c": "2"}, "a.b": "3", "b,c": "4"}, order)
+	require.NoError(t, err)
+	assert.Equal(t, `{"b,c":"4","a.b":"3","a":{"c":"2","b":"1"}}`+"\n", out.String())
+}
+
+type testHeaderWriter struct {
+	bytes.Buffer
+
+	header string
+}
+
+func (w *testHeaderWriter) WriteHeader(header []byte) error {
+	w.header = string(header)
+	return nil
+}
+
+func TestCSVEncoderHeaderWriter(t *testing.T) {
+	t.Parallel()
+
+	out := testHeaderWriter{Buffer: bytes.Buffer{}, header: ""}
+	encoder := regex2json.NewCSVEncoder(&out, ',', nil)
+	err := encoder.Encode(map[string]any{"a": "1", "b": "2"}, nil)
+	require.NoError(t, err)
+	err = encoder.Encode(map[string]any{"a": "3"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "a,b\n", out.header)
+	assert.Equal(t, "1,2\n3,\n", out.String())
+}
@@ -0,0 +1,110 @@
+package regex2json
+
+import (
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+
+	textencoding "golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+// ParseEncoding returns the character encoding with the IANA name
+// (e.g., ISO-8859-1, windows-1252, UTF-16LE) or one of its aliases.
+func ParseEncoding(name string) (textencoding.Encoding, error) { //nolint:ireturn
+	e, err := ianaindex.IANA.Encoding(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unknown encoding: %s", ErrInvalidValue, name)
+	}
+	if e == nil {
+		return nil, fmt.Errorf("%w: unsupported encoding: %s", ErrInvalidValue, name)
+	}
+	return e, nil
+}
+
+// UTF8Policy determines what is done with lines with invalid UTF-8.
+type UTF8Policy int
+
+const (
+	// UTF8Keep keeps invalid bytes as they are, which are then replaced
+	// with U+FFFD when encoded into JSON.
+	UTF8Keep UTF8Policy = iota
+	// UTF8Replace replaces every invalid byte with U+FFFD before matching.
+	UTF8Replace
+	// UTF8Escape replaces every invalid byte with \xNN before matching.
+	UTF8Escape
+	// UTF8Unmatched writes the whole line to unmatched writer.
+	UTF8Unmatched
+)
+
+var utf8PolicyNames = map[UTF8Policy]string{ //nolint:gochecknoglobals
+	UTF8Keep:      "keep",
+	UTF8Replace:   "replace",
+	UTF8Escape:    "escape",
+	UTF8Unmatched: "unmatched",
+}
+
+// ParseUTF8Policy parses the name of the invalid UTF-8 policy.
+func ParseUTF8Policy(name string) (UTF8Policy, error) {
+	for policy, n := range utf8PolicyNames {
+		if n == name {
+			return policy, nil
+		}
+	}
+	return UTF8Keep, fmt.Errorf("%w: unknown invalid UTF-8 policy: %s", ErrInvalidValue, name)
+}
+
+// String returns the name of the invalid UTF-8 policy.
+func (u UTF8Policy) String() string {
+	if name, ok := utf8PolicyNames[u]; ok {
+		return name
+	}
+	return "UTF8Policy(" + strconv.Itoa(int(u)) + ")"
+}
+
+// MarshalText implements [encoding.TextMarshaler] interface.
+func (u UTF8Policy) MarshalText() ([]byte, error) {
+	return []byte(u.String()), nil
+}
+
+// UnmarshalText implements [encoding.TextUnmarshaler] interface.
+func (u *UTF8Policy) UnmarshalText(text []byte) error {
+	policy, err := ParseUTF8Policy(string(text))
+	if err != nil {
+		return err
+	}
+	*u = policy
+	return nil
+}
+
+// fixInvalidUTF8 applies the policy to the line. It returns false
+// if the line should be written to unmatched writer.
+func fixInvalidUTF8(line []byte, policy UTF8Policy) ([]byte, bool) {
+	if policy == UTF8Keep || utf8.Valid(line) {
+		return line, true
+	}
+
+	switch policy {
+	case UTF8Keep:
+		return line, true
+	case UTF8Unmatched:
+		return line, false
+	case UTF8Replace, UTF8Escape:
+	}
+
+	res := make([]byte, 0, len(line))
+	for len(line) > 0 {
+		r, size := utf8.DecodeRune(line)
+		if r == utf8.RuneError && size == 1 {
+			if policy == UTF8Escape {
+				res = fmt.Appendf(res, `\x%02X`, line[0])
+			} else {
+				res = utf8.AppendRune(res, utf8.RuneError)
+			}
+		} else {
+			res = append(res, line[:size]...)
+		}
+		line = line[size:]
+	}
+	return res, true
+}
@@ -0,0 +1,96 @@
+package regex2json_test
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/tozd/regex2json"
+)
+
+func TestTransformerEncoding(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		encoding string
+		input    []byte
+		expected string
+	}{
+		{"ISO-8859-1", []byte("caf\xe9 ok\n"), `{"msg":"ok","word":"café"}` + "\n"},
+		{"windows-1252", []byte("caf\xe9 \x80ok\n"), `{"msg":"€ok","word":"café"}` + "\n"},
+		{"UTF-16LE", []byte("c\x00a\x00f\x00\xe9\x00 \x00o\x00k\x00\n\x00"), `{"msg":"ok","word":"café"}` + "\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.encoding, func(t *testing.T) {
+			t.Parallel()
+
+			e, err := regex2json.ParseEncoding(tt.encoding)
+			require.NoError(t, err)
+
+			tr := newTransformer(regexp.MustCompile(`^(?P<word>\S+) (?P<msg>.+)$`))
+			tr.Encoding = e
+			out := bytes.Buffer{}
+			err = tr.Transform(bytes.NewReader(tt.input), &out, &out)
+			require.NoError(t, err, "% -+#.1v", err)
+			assert.Equal(t, tt.expected, out.String())
+		})
+	}
+}
+
+func TestCompiledTransformerTransformLineEncoding(t *testing.T) {
+	t.Parallel()
+
+	e, err := regex2json.ParseEncoding("ISO-8859-1")
+	require.NoError(t, err)
+
+	tr := newTransformer(regexp.MustCompile(`^(?P<word>\S+)$`))
+	tr.Encoding = e
+	c, err := tr.Compile()
+	require.NoError(t, err)
+
+	record, err := c.TransformLine([]byte("caf\xe9"))
+	require.NoError(t, err, "% -+#.1v", err)
+	assert.Equal(t, "café", record.Raw)
+	assert.Equal(t, map[string]any{"word": "café"}, record.Fields)
+}
+
+func TestParseEncodingErrors(t *testing.T) {
+	t.Parallel()
+
+	_, err := regex2json.ParseEncoding("foobar")
+	assert.EqualError(t, err, "invalid value: unknown encoding: foobar")
+}
+
+func TestTransformerInvalidUTF8(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		policy    regex2json.UTF8Policy
+		matched   string
+		unmatched string
+	}{
+		{regex2json.UTF8Keep, `{"msg":"a��b"}` + "\n", ""},
+		{regex2json.UTF8Replace, `{"msg":"a��b"}` + "\n", ""},
+		{regex2json.UTF8Escape, `{"msg":"a\\xFF\\xFEb"}` + "\n", ""},
+		{regex2json.UTF8Unmatched, "", "a\xff\xfeb\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			t.Parallel()
+
+			tr := newTransformer(regexp.MustCompile(`^(?P<msg>.+)$`))
+			tr.InvalidUTF8 = tt.policy
+			out := bytes.Buffer{}
+			outerr := bytes.Buffer{}
+			err := tr.Transform(bytes.NewReader([]byte("a\xff\xfeb\n")), &out, &outerr)
+			require.NoError(t, err, "% -+#.1v", err)
+			assert.Equal(t, tt.matched, out.String())
+			assert.Equal(t, tt.unmatched, outerr.String())
+		})
+	}
+}
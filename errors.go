@@ -2,6 +2,8 @@ package regex2json
 
 import (
 	"errors"
+	"reflect"
+	"strings"
 )
 
 var (
@@ -17,4 +19,87 @@ var (
 	ErrEmptyOperator        = errors.New("empty operator")
 	ErrInvalidOperator      = errors.New("invalid operator")
 	ErrCompilingOperator    = errors.New("compiling operator")
+	ErrReadingInput         = errors.New("reading input")
 )
+
+// ExpressionError is an error applying an [Expression] on a value.
+type ExpressionError struct {
+	// Expression is the original expression.
+	Expression string
+
+	// Operator is the name of the operator which failed.
+	// It is empty if merging failed.
+	Operator string
+
+	// Index is the index of the failed operator in the expression,
+	// with 0 being the first (possibly implicit) operator.
+	// It is -1 if merging failed.
+	Index int
+
+	// Path is the path of the field in the output JSON. If merging failed,
+	// this is the path at which merging failed. Otherwise it is the path of
+	// the implicit object operator, if any.
+	Path []string
+
+	// Value is the input value.
+	Value string
+
+	// Line is the line number of the input line, starting with 1.
+	// It is 0 if unknown.
+	Line int
+
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *ExpressionError) Error() string {
+	var b strings.Builder
+	if len(e.Path) > 0 {
+		b.WriteString(strings.Join(e.Path, "__"))
+		b.WriteString(": ")
+	}
+	if e.Operator != "" {
+		b.WriteString(e.Operator)
+		b.WriteString(": ")
+	}
+	b.WriteString(e.Err.Error())
+	return b.String()
+}
+
+func (e *ExpressionError) Unwrap() error {
+	return e.Err
+}
+
+// DecodeError is an error decoding a record into a Go value.
+type DecodeError struct {
+	// Path is the path of the field in the record, with indices
+	// of array elements as strings. It is empty for the record itself.
+	Path []string
+
+	// Type is the Go type into which the value could not be decoded.
+	Type reflect.Type
+
+	// Value is the value which could not be decoded.
+	Value any
+
+	// Line is the line number of the input line, starting with 1.
+	// It is 0 if unknown.
+	Line int
+
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	var b strings.Builder
+	if len(e.Path) > 0 {
+		b.WriteString(strings.Join(e.Path, FlattenSeparator))
+		b.WriteString(": ")
+	}
+	b.WriteString(e.Err.Error())
+	return b.String()
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
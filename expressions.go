@@ -6,10 +6,16 @@ package regex2json
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
+	"reflect"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/tkuchiki/go-timezone"
 )
@@ -26,6 +32,20 @@ const (
 	optional optionalType = iota
 )
 
+type paddingType int
+
+const (
+	// Singleton for elements of arrays before the index at which an array segment
+	// put the value, so that they can be distinguished from null values.
+	// Padding gets replaced with null eventually.
+	padding paddingType = iota
+)
+
+// MarshalJSON implements [json.Marshaler] interface.
+func (paddingType) MarshalJSON() ([]byte, error) {
+	return []byte("null"), nil
+}
+
 var tz = timezone.New() //nolint:gochecknoglobals
 
 func toStringOrSkip(in any) (string, bool, error) {
@@ -225,37 +245,185 @@ func OptionalOperator(args ...string) (Op, error) {
 	}, nil
 }
 
+type arraySegmentKind int
+
+const (
+	arrayIndex arraySegmentKind = iota
+	arrayAppend
+	arrayLast
+)
+
+// arraySegment is a value at a position in an array, as constructed by object operator
+// for array segments of its path. It is converted into an array when merged.
+type arraySegment struct {
+	kind  arraySegmentKind
+	index int
+	value any
+}
+
+func (a arraySegment) String() string {
+	switch a.kind {
+	case arrayAppend:
+		return "INEW"
+	case arrayLast:
+		return "ILAST"
+	case arrayIndex:
+	}
+	return "I" + strconv.Itoa(a.index)
+}
+
+// MaxArrayIndex is the largest index N which can be used in IN array segments
+// of object operator's path (see [ObjectOperator]).
+const MaxArrayIndex = 1000
+
+// parseArraySegment returns an arraySegment (without value) if arg
+// is an array segment of object operator's path. It returns an error
+// if arg is an array segment with an index larger than [MaxArrayIndex].
+func parseArraySegment(arg string) (arraySegment, bool, error) {
+	switch arg {
+	case "INEW":
+		return arraySegment{kind: arrayAppend, index: 0, value: nil}, true, nil
+	case "ILAST":
+		return arraySegment{kind: arrayLast, index: 0, value: nil}, true, nil
+	}
+	index, ok := strings.CutPrefix(arg, "I")
+	if !ok || index == "" || strings.Trim(index, "0123456789") != "" {
+		return arraySegment{}, false, nil //nolint:exhaustruct
+	}
+	i, err := strconv.Atoi(index)
+	if err != nil || i > MaxArrayIndex {
+		return arraySegment{}, true, fmt.Errorf("%w: array index larger than %d: %s", ErrInvalidValue, MaxArrayIndex, arg) //nolint:exhaustruct
+	}
+	return arraySegment{kind: arrayIndex, index: i, value: nil}, true, nil
+}
+
+// materialize converts all arraySegments in value into arrays,
+// padding them with padding before the index of the value.
+func materialize(value any) any {
+	switch v := value.(type) {
+	case arraySegment:
+		var a []any
+		if v.kind == arrayIndex {
+			a = pad(nil, v.index+1)
+		} else {
+			a = make([]any, 1)
+		}
+		a[len(a)-1] = materialize(v.value)
+		return a
+	case map[string]any:
+		for key, e := range v {
+			v[key] = materialize(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = materialize(e)
+		}
+	}
+	return value
+}
+
+// pad appends padding to a so that it has length n.
+func pad(a []any, n int) []any {
+	for len(a) < n {
+		a = append(a, padding)
+	}
+	return a
+}
+
+// unpad replaces all padding in value with nil.
+func unpad(value any) any {
+	switch v := value.(type) {
+	case paddingType:
+		return nil
+	case map[string]any:
+		for key, e := range v {
+			v[key] = unpad(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = unpad(e)
+		}
+	}
+	return value
+}
+
 // ObjectOperator returns the object operator which constructs an (possibly nested)
 // object based on provided path as arguments. E.g., calling it with arguments foo
 // and bar will return an object {"foo": {"bar": <in>}}.
+//
+// Path can contain array segments which construct an array at that position
+// instead of an object:
+//
+//   - IN (e.g., I0, I1) puts the value at index N of the array, where N is
+//     at most [MaxArrayIndex]
+//   - INEW appends the value as a new element to the end of the array
+//   - ILAST merges the value into the last element of the array
+//     (or appends it if the array is empty)
+//
+// E.g., calling it with arguments spans, INEW, and name will return an object
+// {"spans": [{"name": <in>}]} which, when merged, appends a new element to the
+// spans array, while with arguments spans, ILAST, and dur the dur field is
+// merged into the last element of the spans array.
+//
+// The first segment of the path cannot be an array segment. In expressions,
+// array segments are recognized before _xHH_ escapes are decoded, so keys named
+// INEW, ILAST, or I followed by digits can be written with an escape (e.g.,
+// foo__x49_0 is object's path with keys foo and I0).
 func ObjectOperator(args ...string) (Op, error) {
+	return objectOperator(args, args)
+}
+
+// objectOperator is like ObjectOperator, but array segments are recognized
+// in raw arguments, which are arguments before escapes are decoded.
+func objectOperator(args, raw []string) (Op, error) {
 	if len(args) == 0 {
 		return nil, fmt.Errorf("%w: path", ErrMissingArgument)
 	}
+	if _, ok, _ := parseArraySegment(raw[0]); ok {
+		return nil, fmt.Errorf("%w: path cannot start with array segment: %s", ErrInvalidValue, args[0])
+	}
+	segments := make([]*arraySegment, len(args))
+	for i, arg := range raw {
+		segment, ok, err := parseArraySegment(arg)
+		if err != nil {
+			return nil, err
+		} else if ok {
+			segments[i] = &segment
+		}
+	}
 	return func(in any) (any, error) {
 		// We discard optional value.
 		if in == optional {
 			return in, nil
 		}
 
-		res := map[string]any{}
-
-		current := res
-		for i, arg := range args {
-			// Are we on the last segment of the path?
-			if i == len(args)-1 {
-				current[arg] = in
+		// We construct the value from the last segment of the path to the first.
+		value := in
+		for i := len(args) - 1; i > 0; i-- {
+			if segments[i] != nil {
+				segment := *segments[i]
+				segment.value = value
+				value = segment
 			} else {
-				m := map[string]any{}
-				current[arg] = m
-				current = m
+				value = map[string]any{args[i]: value}
 			}
 		}
 
-		return res, nil
+		return map[string]any{args[0]: value}, nil
 	}, nil
 }
 
+func locationName(arg string) string {
+	// Location was provided with escaped /, so we use it as-is.
+	if strings.Contains(arg, "/") {
+		return arg
+	}
+	// Capture group names in Go support only a limited set of characters.
+	// So we replace the first _ with / which is common in time zone names.
+	// See: https://github.com/golang/go/issues/60784
+	return strings.Replace(arg, "_", "/", 1)
+}
+
 // TimeOperator returns the time operator which parses the input string
 // into a timestamp and then formats the timestamp back into a string.
 //
@@ -265,6 +433,10 @@ func ObjectOperator(args ...string) (Op, error) {
 //   - formatting layout (default RFC3339Milli)
 //   - formatting location (default [time.UTC])
 //   - parsing location (default [time.Local])
+//
+// In locations, the first _ is replaced with / (e.g., Europe_Ljubljana
+// is Europe/Ljubljana), unless the location already contains / (e.g., when
+// escaped as America_x2f_Argentina_x2f_Buenos_Aires).
 func TimeOperator(args ...string) (Op, error) {
 	if len(args) == 0 {
 		return nil, fmt.Errorf("%w: parse layout", ErrMissingArgument)
@@ -285,10 +457,7 @@ func TimeOperator(args ...string) (Op, error) {
 	var err error
 	formatLocation := time.UTC // Default.
 	if len(args) > 2 {         //nolint:mnd
-		// Capture group names in Go support only a limited set of characters.
-		// So we replace the first _ with / which is common in time zone names.
-		// See: https://github.com/golang/go/issues/60784
-		formatLocation, err = time.LoadLocation(strings.Replace(args[2], "_", "/", 1))
+		formatLocation, err = time.LoadLocation(locationName(args[2]))
 		if err != nil {
 			return nil, fmt.Errorf(`%w: location "%s": %w`, ErrInvalidValue, args[2], err)
 		}
@@ -296,10 +465,7 @@ func TimeOperator(args ...string) (Op, error) {
 	//nolint:gosmopolitan
 	parseLocation := time.Local // Default.
 	if len(args) > 3 {          //nolint:mnd
-		// Capture group names in Go support only a limited set of characters.
-		// So we replace the first _ with / which is common in time zone names.
-		// See: https://github.com/golang/go/issues/60784
-		parseLocation, err = time.LoadLocation(strings.Replace(args[3], "_", "/", 1))
+		parseLocation, err = time.LoadLocation(locationName(args[3]))
 		if err != nil {
 			return nil, fmt.Errorf(`%w: location "%s": %w`, ErrInvalidValue, args[3], err)
 		}
@@ -396,17 +562,180 @@ func JSONOperator(args ...string) (Op, error) {
 	}, nil
 }
 
+// Patterns is a map of named regexps available to [RegexOperator].
+var Patterns = map[string]*regexp.Regexp{} //nolint:gochecknoglobals
+
+// RegexOperator returns the regex operator which matches the input string
+// with a named regexp from [Patterns]. Capture groups' names of that regexp
+// are compiled into Expressions and values they capture are transformed and
+// combined into an object, which is the output of the operator. This enables
+// hierarchical parsing of values captured by the outer regexp.
+//
+// If the regexp can match multiple times, all matches are combined together
+// into the same one object. It is an error if the regexp does not match.
+//
+// The regexp must not (directly or indirectly) reference itself. Conflicting
+// values are merged according to the merge strategy of the [Transformer] (or
+// expressions' own merge strategies), by default failing with an error.
+//
+// It accepts one argument, the name of the regexp in [Patterns] (required).
+func RegexOperator(args ...string) (Op, error) {
+	op, _, err := compiler{strategy: MergeDefault, patterns: nil}.regexOperator(args...)
+	return op, err
+}
+
+// compiler holds the state shared between compiling an expression and
+// compiling expressions of patterns it references using the regex operator.
+type compiler struct {
+	// Default merge strategy used when applying expressions of patterns.
+	strategy MergeStrategy
+	// Names of patterns currently being compiled.
+	patterns []string
+}
+
+// regexOperator is like RegexOperator, but it also returns compiled expressions
+// of the pattern.
+func (c compiler) regexOperator(args ...string) (Op, []*Expression, error) {
+	if len(args) == 0 {
+		return nil, nil, fmt.Errorf("%w: pattern name", ErrMissingArgument)
+	} else if len(args) > 1 {
+		return nil, nil, fmt.Errorf("%w: %s", ErrUnexpectedArgument, strings.Join(args[1:], ", "))
+	}
+	r, ok := Patterns[args[0]]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: unknown pattern: %s", ErrInvalidValue, args[0])
+	}
+	if slices.Contains(c.patterns, args[0]) {
+		return nil, nil, fmt.Errorf("%w: pattern references itself: %s -> %s", ErrInvalidValue, strings.Join(c.patterns, " -> "), args[0])
+	}
+	c.patterns = append(slices.Clone(c.patterns), args[0])
+	expressions, err := c.compileExpressions(r, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf(`%w: pattern "%s": %w`, ErrCompilingExpressions, args[0], err)
+	}
+	strategy := c.strategy
+	return func(in any) (any, error) {
+		s, skip, err := toStringOrSkip(in)
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			return in, nil
+		}
+		matches := r.FindAllStringSubmatch(s, -1)
+		if len(matches) == 0 {
+			return nil, fmt.Errorf(`%w: "%s" does not match pattern "%s"`, ErrInvalidValue, s, args[0])
+		}
+		output := map[string]any{}
+		for _, match := range matches {
+			for i, value := range match {
+				// Nil expressions we skip.
+				if expressions[i] == nil {
+					continue
+				}
+				err := expressions[i].apply(output, value, strategy)
+				if err != nil {
+					return nil, fmt.Errorf(`pattern "%s": %w`, args[0], err)
+				}
+			}
+		}
+		return output, nil
+	}, expressions, nil
+}
+
 // Library is a map of all supported operators.
+//
+// Operators can be added or replaced. The regex operator uses the merge strategy
+// of the [Transformer] and detects patterns which reference themselves only while
+// it is [RegexOperator] itself, not when it is replaced or wrapped.
 var Library = map[string]func(args ...string) (Op, error){ //nolint:gochecknoglobals
-	"int":      IntOperator,
-	"float":    FloatOperator,
-	"bool":     BoolOperator,
-	"array":    ArrayOperator,
-	"null":     NullOperator,
-	"optional": OptionalOperator,
-	"object":   ObjectOperator,
-	"time":     TimeOperator,
-	"json":     JSONOperator,
+	"int":        IntOperator,
+	"float":      FloatOperator,
+	"bool":       BoolOperator,
+	"array":      ArrayOperator,
+	"null":       NullOperator,
+	"optional":   OptionalOperator,
+	"object":     ObjectOperator,
+	"time":       TimeOperator,
+	"json":       JSONOperator,
+	"url":        URLOperator,
+	"query":      QueryOperator,
+	"ip":         IPOperator,
+	"cidr":       CIDROperator,
+	"geoip":      GeoIPOperator,
+	"useragent":  UserAgentOperator,
+	"redact":     RedactOperator,
+	"hash":       HashOperator,
+	"iptruncate": IPTruncateOperator,
+	"base64":     Base64Operator,
+	"hex":        HexOperator,
+	"urldecode":  URLDecodeOperator,
+}
+
+//nolint:gochecknoinits
+func init() {
+	// RegexOperator compiles expressions itself so it cannot be
+	// listed in Library's initializer without an initialization cycle.
+	Library["regex"] = RegexOperator
+}
+
+// MergeStrategy determines how conflicting values are merged.
+// Values conflict when neither of them is an array and they are not both objects.
+type MergeStrategy int
+
+const (
+	// MergeDefault uses the strategy configured elsewhere (e.g., on [Transformer]),
+	// defaulting to MergeError.
+	MergeDefault MergeStrategy = iota
+	// MergeError fails with an error for conflicting values, keeping the first value.
+	MergeError
+	// MergeFirst keeps the first value.
+	MergeFirst
+	// MergeLast replaces the first value with the last value.
+	MergeLast
+	// MergeCollect collects conflicting values into an array.
+	MergeCollect
+)
+
+var mergeStrategyNames = map[MergeStrategy]string{ //nolint:gochecknoglobals
+	MergeDefault: "default",
+	MergeError:   "error",
+	MergeFirst:   "first",
+	MergeLast:    "last",
+	MergeCollect: "collect",
+}
+
+// ParseMergeStrategy parses the name of the merge strategy.
+func ParseMergeStrategy(name string) (MergeStrategy, error) {
+	for strategy, n := range mergeStrategyNames {
+		if n == name {
+			return strategy, nil
+		}
+	}
+	return MergeDefault, fmt.Errorf("%w: unknown merge strategy: %s", ErrInvalidValue, name)
+}
+
+// String returns the name of the merge strategy.
+func (m MergeStrategy) String() string {
+	if name, ok := mergeStrategyNames[m]; ok {
+		return name
+	}
+	return "MergeStrategy(" + strconv.Itoa(int(m)) + ")"
+}
+
+// MarshalText implements [encoding.TextMarshaler] interface.
+func (m MergeStrategy) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText implements [encoding.TextUnmarshaler] interface.
+func (m *MergeStrategy) UnmarshalText(text []byte) error {
+	strategy, err := ParseMergeStrategy(string(text))
+	if err != nil {
+		return err
+	}
+	*m = strategy
+	return nil
 }
 
 // Expression is a compiled expression which can be applied on a value
@@ -433,125 +762,347 @@ var Library = map[string]func(args ...string) (Op, error){ //nolint:gochecknoglo
 // to (default) RFC3339Milli layout. The formatted time is thus stored in
 // the object. E.g., for input "Fri Jun  9 22:21:17 CEST 2023" the output
 // is {"foo": {"bar": "2023-06-09T20:21:17.000Z"}}.
+//
+// Because capture groups' names in Go support only characters [A-Za-z0-9_],
+// any byte can be written as an escape _xHH_, where HH are two hexadecimal
+// digits. Escapes are decoded in operators' names and arguments (including
+// object's path) after the expression is split, so escaped underscores
+// never act as separators. E.g., _x40_timestamp is the key @timestamp,
+// http_x2e_status is the key http.status, and a_x5f__x5f_b is the key a__b.
+// An escape directly after a separator shares its leading underscore with
+// the separator, e.g., foo__x2e_bar is object's path with keys foo and .bar.
+// So a key or an argument after a separator which itself starts with x,
+// two hexadecimal digits, and _ has to have its x escaped, e.g.,
+// foo__x78_2e_bar is object's path with keys foo and x2e_bar.
+//
+// Instead of an operator, the expression can contain merge followed by the name
+// of a [MergeStrategy] to use when merging the Expression's output (first, last,
+// collect, or error). E.g., foo___merge__last___int keeps the last int value
+// when regexp matches multiple times.
 type Expression struct {
 	expression string
 	fns        []Op
+	// Names of operators, in the same order as fns.
+	operators []string
+	// Indices of operators in the expression, in the same order as fns.
+	indices []int
+	path    []string
+	// Object's path without array segments, used for the order of fields.
+	fieldPath []string
+	// Expressions which produce outputs of operators (e.g., of the regex operator),
+	// used for the order of fields.
+	nested   []*Expression
+	strategy MergeStrategy
 }
 
 // Apply runs the Expression on the value and transforms it by calling operators
 // one after the other. Expression always returns an object which is then merged
-// into output.
+// into output using [Merge].
 //
-// Merging of objects is recursive and is designed so that multiple Expressions
-// can be applied using the same output, which collects results from those Expressions.
+// Merging is designed so that multiple Expressions can be applied using the same output,
+// which collects results from those Expressions. Conflicting values are merged according
+// to the Expression's [MergeStrategy], by default failing with an error.
 //
-// Objects are merged by merging their fields. Arrays are merged by concatenating them.
-// Object is merged with an array by merging the object with the first element of the
-// array, when it is the first element is an object. Otherwise the object is prepended
-// to the array. Array is merged with an object in a similar way, only merging is done
-// with the last element of the array (if it is an object) or the object is appended
-// to the array. Merging other values with the array prepends them. Merging an array
-// with other values appends them.
+// Elements of arrays before the index at which an array segment (see [ObjectOperator])
+// put a value can be set by later Expressions. Until then, they are not nil, so that they
+// can be distinguished from null values, but they are encoded into JSON as null.
 func (s Expression) Apply(output map[string]any, value string) error {
+	return s.apply(output, value, MergeDefault)
+}
+
+// apply is like Apply, but uses defaultStrategy if the Expression does
+// not have its own merge strategy.
+func (s Expression) apply(output map[string]any, value string, defaultStrategy MergeStrategy) error {
+	in, err := s.evaluate(value)
+	if err != nil {
+		return err
+	}
+	// Value has been discarded.
+	if in == optional {
+		return nil
+	}
+	// The first operator is generally the object, but it can be skipped.
+	result, ok := in.(map[string]any)
+	if !ok {
+		return &ExpressionError{
+			Expression: s.expression,
+			Operator:   "",
+			Index:      -1,
+			Path:       nil,
+			Value:      value,
+			Line:       0,
+			Err:        fmt.Errorf("%w: result is not an object, but %T", ErrUnexpectedType, in),
+		}
+	}
+	strategy := s.strategy
+	if strategy == MergeDefault {
+		strategy = defaultStrategy
+	}
+	err = Merge(output, result, strategy)
+	if err != nil {
+		var eErr *ExpressionError
+		if errors.As(err, &eErr) {
+			eErr.Expression = s.expression
+			eErr.Value = value
+		}
+		return err
+	}
+	return nil
+}
+
+// addFieldOrder adds paths of fields the Expression produces to order, under parent path.
+func (s Expression) addFieldOrder(order *FieldOrder, parent []string) {
+	path := append(slices.Clone(parent), s.fieldPath...)
+	if len(path) > 0 {
+		order.add(path)
+	}
+	for _, expression := range s.nested {
+		if expression != nil {
+			expression.addFieldOrder(order, path)
+		}
+	}
+}
+
+// Evaluate runs the Expression on the value and transforms it by calling operators
+// one after the other, returning the result without merging it anywhere.
+// The result is generally an object, but it can be any value if the first
+// (object) operator is skipped. If the value has been discarded (e.g., by
+// the optional operator), nil is returned.
+//
+// Array segments in the result (see [ObjectOperator]) are converted into arrays,
+// so merging the result using [Merge] merges arrays and does not append to or
+// merge into the last element of an existing array, like [Expression.Apply] does.
+//
+// The returned error is an [ExpressionError].
+func (s Expression) Evaluate(value string) (any, error) {
+	in, err := s.evaluate(value)
+	if err != nil {
+		return nil, err
+	}
+	// We discard optional value.
+	if in == optional {
+		return nil, nil //nolint:nilnil
+	}
+	return unpad(materialize(in)), nil
+}
+
+// evaluate is like Evaluate, but it returns the optional value if the value
+// has been discarded and it does not convert array segments into arrays.
+func (s Expression) evaluate(value string) (any, error) {
 	var in any = value
 	var err error
-	for _, f := range s.fns {
+	for i, f := range s.fns {
 		in, err = f(in)
 		if err != nil {
-			return err
+			return nil, &ExpressionError{
+				Expression: s.expression,
+				Operator:   s.operators[i],
+				Index:      s.indices[i],
+				Path:       slices.Clone(s.path),
+				Value:      value,
+				Line:       0,
+				Err:        err,
+			}
 		}
 	}
-	// We discard optional value.
-	if in == optional {
-		return nil
+	return in, nil
+}
+
+// MergeStrategy returns the Expression's merge strategy. It is [MergeDefault]
+// if the expression does not set its own merge strategy.
+func (s Expression) MergeStrategy() MergeStrategy {
+	return s.strategy
+}
+
+// Merge merges right object into left object, modifying left object in-place.
+// Values from right object might be reused in left object.
+//
+// Merging of objects is recursive. Objects are merged by merging their fields.
+// Arrays are merged by concatenating them.
+// Object is merged with an array by merging the object with the first element of the
+// array, when it is the first element is an object. Otherwise the object is prepended
+// to the array. Array is merged with an object in a similar way, only merging is done
+// with the last element of the array (if it is an object) or the object is appended
+// to the array. Merging other values with the array prepends them. Merging an array
+// with other values appends them.
+//
+// To precisely control where in an array the value is merged, use array segments
+// in object's path (see [ObjectOperator]).
+//
+// Other values conflict and they are merged according to the strategy.
+// [MergeDefault] is the same as [MergeError].
+//
+// The returned error is an [ExpressionError] with the path at which merging failed.
+func Merge(left, right map[string]any, strategy MergeStrategy) error {
+	return merge(left, right, strategy)
+}
+
+// prefixMergeError prepends segment to the path of err.
+func prefixMergeError(segment string, err error) error {
+	var eErr *ExpressionError
+	if errors.As(err, &eErr) {
+		eErr.Path = append([]string{segment}, eErr.Path...)
+		return eErr
+	}
+	return &ExpressionError{
+		Expression: "",
+		Operator:   "",
+		Index:      -1,
+		Path:       []string{segment},
+		Value:      "",
+		Line:       0,
+		Err:        err,
 	}
-	// The first operator is the object, so we know the type of in.
-	return s.merge(output, in.(map[string]any)) //nolint:forcetypeassert,errcheck
 }
 
-func (s Expression) merge(left map[string]any, right map[string]any) error {
-	for key, rightValue := range right {
+func merge(left map[string]any, right map[string]any, strategy MergeStrategy) error {
+	// We iterate over sorted keys so that errors are deterministic.
+	for _, key := range slices.Sorted(maps.Keys(right)) {
+		rightValue := right[key]
 		leftValue, ok := left[key]
 		if ok {
-			switch lv := leftValue.(type) {
+			value, err := mergeValues(leftValue, rightValue, strategy)
+			if err != nil {
+				return prefixMergeError(key, err)
+			}
+			left[key] = value
+		} else {
+			left[key] = materialize(rightValue)
+		}
+	}
+
+	return nil
+}
+
+// mergeConflict merges conflicting values according to strategy.
+func mergeConflict(leftValue, rightValue any, strategy MergeStrategy, err error) (any, error) {
+	switch strategy {
+	case MergeFirst:
+		return leftValue, nil
+	case MergeLast:
+		return materialize(rightValue), nil
+	case MergeCollect:
+		return []any{leftValue, materialize(rightValue)}, nil
+	case MergeDefault, MergeError:
+	}
+	return nil, err
+}
+
+func mergeValues(leftValue, rightValue any, strategy MergeStrategy) (any, error) {
+	if segment, ok := rightValue.(arraySegment); ok {
+		return mergeArraySegment(leftValue, segment, strategy)
+	}
+
+	switch lv := leftValue.(type) {
+	case map[string]any:
+		switch rv := rightValue.(type) {
+		case map[string]any:
+			// Left and right are maps. We merge them.
+			err := merge(lv, rv, strategy)
+			if err != nil {
+				return nil, err
+			}
+			return lv, nil
+		case []any:
+			if len(rv) == 0 {
+				// Left is a map, right is an empty slice. We wrap the map into an slice.
+				return []any{leftValue}, nil
+			}
+			switch r := rv[0].(type) {
 			case map[string]any:
-				switch rv := rightValue.(type) {
-				case map[string]any:
-					// Left and right are maps. We merge them.
-					err := s.merge(lv, rv)
-					if err != nil {
-						return fmt.Errorf("%s__%w", key, err)
-					}
-				case []any:
-					if len(rv) == 0 {
-						// Left is a map, right is an empty slice. We wrap the map into an slice.
-						left[key] = []any{leftValue}
-					} else {
-						switch r := rv[0].(type) {
-						case map[string]any:
-							// Left is a map, right is a slice and the first element of right is a map.
-							// We merge left into the first element of the slice and the slice is the result.
-							err := s.merge(lv, r)
-							if err != nil {
-								return fmt.Errorf("%s__%w", key, err)
-							}
-							rv[0] = lv
-							left[key] = rv
-						default:
-							// Left is a map, right is a slice and the first element of right is not a map.
-							// We prepend the map to the slice.
-							left[key] = append([]any{lv}, rv...)
-						}
-					}
-				default:
-					// Left is a map, right is not a map nor a slice. We do not know how to merge that.
-					return fmt.Errorf("%s: %w", key, ErrTypeMismatch)
-				}
-			case []any:
-				switch rv := rightValue.(type) {
-				case map[string]any:
-					if len(lv) == 0 {
-						// Left is an empty slice, right is a map. We wrap the map into an slice.
-						left[key] = []any{rightValue}
-					} else {
-						switch l := lv[len(lv)-1].(type) {
-						case map[string]any:
-							// Left is a slice and the last element of left is a map, right is a map.
-							// We merge right into the last element of the slice and the slice is the result.
-							err := s.merge(l, rv)
-							if err != nil {
-								return fmt.Errorf("%s__%w", key, err)
-							}
-							lv[len(lv)-1] = l
-							left[key] = lv
-						default:
-							// Left is a slice and the last element of left is not a map, right is a map.
-							// We append the map to the slice.
-							left[key] = append(lv, rv)
-						}
-					}
-				case []any:
-					// Left is a slice, right is a slice. We concatenate right to the end of left.
-					left[key] = append(lv, rv...)
-				default:
-					// Left is a slice, right is not a map nor a slice. We append it to the end of left.
-					left[key] = append(lv, rv)
+				// Left is a map, right is a slice and the first element of right is a map.
+				// We merge left into the first element of the slice and the slice is the result.
+				err := merge(lv, r, strategy)
+				if err != nil {
+					return nil, err
 				}
+				rv[0] = lv
+				return materialize(rv), nil
 			default:
-				switch rv := rightValue.(type) {
-				case []any:
-					// Left is not a map nor a slice, right is a slice. We prepend it to the start of right.
-					left[key] = append([]any{lv}, rv...)
-				default:
-					return fmt.Errorf("%s: %w", key, ErrValueAlreadyExist)
+				// Left is a map, right is a slice and the first element of right is not a map.
+				// We prepend the map to the slice.
+				return append([]any{lv}, materialize(rv).([]any)...), nil //nolint:forcetypeassert,errcheck
+			}
+		default:
+			// Left is a map, right is not a map nor a slice. We do not know how to merge that.
+			return mergeConflict(leftValue, rightValue, strategy, ErrTypeMismatch)
+		}
+	case []any:
+		switch rv := rightValue.(type) {
+		case map[string]any:
+			if len(lv) == 0 {
+				// Left is an empty slice, right is a map. We wrap the map into an slice.
+				return []any{materialize(rightValue)}, nil
+			}
+			switch l := lv[len(lv)-1].(type) {
+			case map[string]any:
+				// Left is a slice and the last element of left is a map, right is a map.
+				// We merge right into the last element of the slice and the slice is the result.
+				err := merge(l, rv, strategy)
+				if err != nil {
+					return nil, err
 				}
+				lv[len(lv)-1] = l
+				return lv, nil
+			default:
+				// Left is a slice and the last element of left is not a map, right is a map.
+				// We append the map to the slice.
+				return append(lv, materialize(rv)), nil
 			}
-		} else {
-			left[key] = rightValue
+		case []any:
+			// Left is a slice, right is a slice. We concatenate right to the end of left.
+			return append(lv, materialize(rv).([]any)...), nil //nolint:forcetypeassert,errcheck
+		default:
+			// Left is a slice, right is not a map nor a slice. We append it to the end of left.
+			return append(lv, rv), nil
+		}
+	default:
+		switch rv := rightValue.(type) {
+		case []any:
+			// Left is not a map nor a slice, right is a slice. We prepend it to the start of right.
+			return append([]any{lv}, materialize(rv).([]any)...), nil //nolint:forcetypeassert,errcheck
+		default:
+			return mergeConflict(leftValue, rightValue, strategy, ErrValueAlreadyExist)
 		}
 	}
+}
 
-	return nil
+func mergeArraySegment(leftValue any, segment arraySegment, strategy MergeStrategy) (any, error) {
+	lv, ok := leftValue.([]any)
+	if !ok {
+		// Left is not a slice, right is an array segment. We do not know how to merge that.
+		return mergeConflict(leftValue, segment, strategy, ErrTypeMismatch)
+	}
+
+	switch segment.kind {
+	case arrayAppend:
+		return append(lv, materialize(segment.value)), nil
+	case arrayLast:
+		if len(lv) == 0 {
+			return append(lv, materialize(segment.value)), nil
+		}
+		value, err := mergeValues(lv[len(lv)-1], segment.value, strategy)
+		if err != nil {
+			return nil, prefixMergeError(segment.String(), err)
+		}
+		lv[len(lv)-1] = value
+		return lv, nil
+	case arrayIndex:
+		// We pad the slice with padding which is replaced with the value.
+		lv = pad(lv, segment.index+1)
+		if lv[segment.index] == padding {
+			lv[segment.index] = materialize(segment.value)
+			return lv, nil
+		}
+		value, err := mergeValues(lv[segment.index], segment.value, strategy)
+		if err != nil {
+			return nil, prefixMergeError(segment.String(), err)
+		}
+		lv[segment.index] = value
+		return lv, nil
+	}
+
+	return nil, fmt.Errorf("%w: unexpected array segment kind: %d", ErrUnexpectedType, segment.kind)
 }
 
 // String returns the original expression used to compile this Expression.
@@ -559,8 +1110,80 @@ func (s Expression) String() string {
 	return s.expression
 }
 
+// escapePlaceholder is the first of 256 runes from Unicode's private use area
+// which are used as placeholders for escaped bytes while splitting the expression.
+const escapePlaceholder = rune(0xF0000)
+
+var escapeRegexp = regexp.MustCompile(`_x([0-9a-fA-F]{2})_`) //nolint:gochecknoglobals
+
+// escapeExpression replaces escapes in expression with placeholders.
+func escapeExpression(expression string) string {
+	return escapeRegexp.ReplaceAllStringFunc(expression, func(escape string) string {
+		b, _ := strconv.ParseUint(escape[2:4], 16, 8)
+		return string(escapePlaceholder + rune(b))
+	})
+}
+
+var escapeSegmentRegexp = regexp.MustCompile(`_+x([0-9a-fA-F]{2})_`) //nolint:gochecknoglobals
+
+// escapeSegments is like escapeExpression, but an escape directly after a separator
+// shares its leading underscore with the separator, so separators are never part of escapes.
+func escapeSegments(expression string) string {
+	return escapeSegmentRegexp.ReplaceAllStringFunc(expression, func(escape string) string {
+		x := strings.IndexByte(escape, 'x')
+		b, _ := strconv.ParseUint(escape[x+1:x+3], 16, 8)
+		placeholder := string(escapePlaceholder + rune(b))
+		if x == 1 {
+			return placeholder
+		}
+		return escape[:x] + placeholder
+	})
+}
+
+// unescapeExpression replaces placeholders in s with bytes they represent.
+func unescapeExpression(s string) string {
+	if !strings.ContainsFunc(s, isEscapePlaceholder) {
+		return s
+	}
+	res := []byte{}
+	for _, r := range s {
+		if isEscapePlaceholder(r) {
+			res = append(res, byte(r-escapePlaceholder))
+		} else {
+			res = utf8.AppendRune(res, r)
+		}
+	}
+	return string(res)
+}
+
+func isEscapePlaceholder(r rune) bool {
+	return r >= escapePlaceholder && r <= escapePlaceholder+0xFF
+}
+
+// operator compiles the operator from Library with args. Raw arguments are
+// arguments before escapes are decoded. Operators which need the compiler's state
+// or raw arguments are compiled by the compiler itself, but only if they have not
+// been replaced in Library.
+//
+// It also returns expressions which produce the operator's output, if any.
+func (c compiler) operator(functor func(args ...string) (Op, error), args, raw []string) (Op, []*Expression, error) {
+	switch reflect.ValueOf(functor).Pointer() {
+	case reflect.ValueOf(RegexOperator).Pointer():
+		return c.regexOperator(args...)
+	case reflect.ValueOf(ObjectOperator).Pointer():
+		op, err := objectOperator(args, raw)
+		return op, nil, err
+	}
+	op, err := functor(args...)
+	return op, nil, err
+}
+
 // NewExpression compiles the expression into the Expression.
 func NewExpression(expression string) (*Expression, error) {
+	return compiler{strategy: MergeDefault, patterns: nil}.newExpression(expression)
+}
+
+func (c compiler) newExpression(expression string) (*Expression, error) {
 	if expression == "" {
 		return nil, ErrEmptyExpression
 	}
@@ -568,34 +1191,74 @@ func NewExpression(expression string) (*Expression, error) {
 	res := &Expression{
 		expression: expression,
 		fns:        make([]Op, 0),
+		operators:  make([]string, 0),
+		indices:    make([]int, 0),
+		path:       nil,
+		fieldPath:  nil,
+		nested:     nil,
+		strategy:   MergeDefault,
 	}
 
-	chain := strings.Split(expression, "___")
+	chain := strings.Split(escapeSegments(expression), "___")
 	// The first operator is implicitly the object. We make it explicit. We do not allow/support
 	// optionally explicit first operator so that we can support "object" as field name in an object.
 	// We also do not want to require that the first object operator should always be specified.
-	if chain[0] == "" {
+	skipObject := chain[0] == ""
+	if skipObject {
 		// The only way to skip the implicit operator is to start the expression with ___.
 		chain = chain[1:]
 	} else {
 		chain[0] = "object__" + chain[0]
 	}
 
-	for _, c := range chain {
-		if c == "" {
+	hasStrategy := false
+	for index, link := range chain {
+		if link == "" {
 			return nil, fmt.Errorf(`%w: expression "%s"`, ErrEmptyOperator, expression)
 		}
-		ops := strings.Split(c, "__")
+		raw := strings.Split(link, "__")
+		ops := make([]string, len(raw))
+		for i, op := range raw {
+			ops[i] = unescapeExpression(op)
+		}
+		// Merge is not an operator, but sets the merge strategy of the expression.
+		if ops[0] == "merge" {
+			if len(ops) == 1 {
+				return nil, fmt.Errorf(`%w: "%s" for expression "%s": %w: merge strategy`, ErrCompilingOperator, ops[0], expression, ErrMissingArgument)
+			} else if len(ops) > 2 { //nolint:mnd
+				return nil, fmt.Errorf(`%w: "%s" for expression "%s": %w: %s`, ErrCompilingOperator, ops[0], expression, ErrUnexpectedArgument, strings.Join(ops[2:], ", "))
+			} else if hasStrategy {
+				return nil, fmt.Errorf(`%w: "%s" for expression "%s": merge strategy already set`, ErrCompilingOperator, ops[0], expression)
+			}
+			strategy, err := ParseMergeStrategy(ops[1])
+			if err != nil {
+				return nil, fmt.Errorf(`%w: "%s" for expression "%s": %w`, ErrCompilingOperator, ops[0], expression, err)
+			}
+			res.strategy = strategy
+			hasStrategy = true
+			continue
+		}
 		functor, ok := Library[ops[0]]
 		if !ok {
 			return nil, fmt.Errorf(`%w: "%s" for expression "%s"`, ErrInvalidOperator, ops[0], expression)
 		}
-		f, err := functor(ops[1:]...)
+		f, nested, err := c.operator(functor, ops[1:], raw[1:])
 		if err != nil {
 			return nil, fmt.Errorf(`%w: "%s" for expression "%s": %w`, ErrCompilingOperator, ops[0], expression, err)
 		}
 		// We prepend the new operator, so that in Apply we call from the last to the first operator.
 		res.fns = append([]Op{f}, res.fns...)
+		res.operators = append([]string{ops[0]}, res.operators...)
+		res.indices = append([]int{index}, res.indices...)
+		res.nested = append(res.nested, nested...)
+		if index == 0 && !skipObject {
+			res.path = ops[1:]
+			for i, arg := range raw[1:] {
+				if _, ok, _ := parseArraySegment(arg); !ok {
+					res.fieldPath = append(res.fieldPath, ops[1+i])
+				}
+			}
+		}
 	}
 
 	return res, nil
@@ -2,6 +2,8 @@ package regex2json_test
 
 import (
 	"encoding/json"
+	"net/netip"
+	"regexp"
 	"strconv"
 	"testing"
 
@@ -46,16 +48,95 @@ var Tests = []struct { //nolint: gochecknoglobals
 	{[]ExpValue{{"foo__bar", "x"}, {"foo___int", "1"}}, `{"foo":{"bar":"x"}}`, []string{`foo: type mismatch`}},
 	{[]ExpValue{{"foo___array___optional", ""}, {"foo", "x"}}, `{"foo":["x"]}`, []string{}},
 	{[]ExpValue{{"foo___array___int", "1"}, {"foo__bar", "x"}}, `{"foo":[1,{"bar":"x"}]}`, []string{}},
+	{[]ExpValue{{"spans__INEW__name", "a"}, {"spans__ILAST__dur___int", "1"}}, `{"spans":[{"dur":1,"name":"a"}]}`, []string{}},
+	{[]ExpValue{{"spans__INEW__name", "a"}, {"spans__INEW__name", "b"}, {"spans__ILAST__dur___int", "2"}}, `{"spans":[{"name":"a"},{"dur":2,"name":"b"}]}`, []string{}},
+	{[]ExpValue{{"spans__ILAST__name", "a"}, {"spans__ILAST__dur___int", "1"}}, `{"spans":[{"dur":1,"name":"a"}]}`, []string{}},
+	{[]ExpValue{{"foo__I2", "x"}}, `{"foo":[null,null,"x"]}`, []string{}},
+	{[]ExpValue{{"foo__I1", "x"}, {"foo__I0", "y"}, {"foo__INEW", "z"}}, `{"foo":["y","x","z"]}`, []string{}},
+	{[]ExpValue{{"foo__I0__a", "x"}, {"foo__I0__b", "y"}, {"foo__I1__a", "z"}}, `{"foo":[{"a":"x","b":"y"},{"a":"z"}]}`, []string{}},
+	{[]ExpValue{{"foo__I0__I1", "x"}, {"foo__I0__I0", "y"}}, `{"foo":[["y","x"]]}`, []string{}},
+	{[]ExpValue{{"foo__I0", "x"}, {"foo__I0", "y"}}, `{"foo":["x"]}`, []string{`foo__I0: value already exist`}},
+	{[]ExpValue{{"foo__I0___null", ""}, {"foo__I0", "y"}}, `{"foo":[null]}`, []string{`foo__I0: value already exist`}},
+	{[]ExpValue{{"foo__I1___null", ""}, {"foo__I1___merge__error", "y"}, {"foo__I0", "x"}}, `{"foo":["x",null]}`, []string{`foo__I1: value already exist`}},
+	{[]ExpValue{{"foo__I0___null", ""}, {"foo__I0___merge__last", "y"}}, `{"foo":["y"]}`, []string{}},
+	{[]ExpValue{{"foo__I0__a", "x"}, {"foo__I0__a", "y"}}, `{"foo":[{"a":"x"}]}`, []string{`foo__I0__a: value already exist`}},
+	{[]ExpValue{{"foo", "x"}, {"foo__INEW", "y"}}, `{"foo":"x"}`, []string{`foo: type mismatch`}},
+	{[]ExpValue{{"foo___array", "x"}, {"foo__INEW", "y"}}, `{"foo":["x","y"]}`, []string{}},
+	{[]ExpValue{{"foo__INEW__a", "x"}, {"foo___array___object__b", "y"}}, `{"foo":[{"a":"x"},{"b":"y"}]}`, []string{}},
+	{[]ExpValue{{"foo___array___object__a__I1", "x"}}, `{"foo":[{"a":[null,"x"]}]}`, []string{}},
+	{[]ExpValue{{"foo__INEW___optional", ""}}, ``, []string{}},
+	{[]ExpValue{{"foo__x49_0", "x"}, {"foo__x49_NEW__bar", "y"}}, `{"foo":{"I0":"x","INEW":{"bar":"y"}}}`, []string{}},
+	{[]ExpValue{{"_x49_0", "x"}}, `{"I0":"x"}`, []string{}},
+	{[]ExpValue{{"foo___merge__first", "x"}, {"foo___merge__first", "y"}}, `{"foo":"x"}`, []string{}},
+	{[]ExpValue{{"foo___merge__last", "x"}, {"foo___merge__last", "y"}}, `{"foo":"y"}`, []string{}},
+	{[]ExpValue{{"foo___merge__collect", "x"}, {"foo___merge__collect", "y"}, {"foo___merge__collect", "z"}}, `{"foo":["x","y","z"]}`, []string{}},
+	{[]ExpValue{{"foo___merge__error", "x"}, {"foo___merge__error", "y"}}, `{"foo":"x"}`, []string{`foo: value already exist`}},
+	{[]ExpValue{{"foo__bar", "x"}, {"foo___merge__last___int", "1"}}, `{"foo":1}`, []string{}},
+	{[]ExpValue{{"foo__bar", "x"}, {"foo___int___merge__first", "1"}}, `{"foo":{"bar":"x"}}`, []string{}},
+	{[]ExpValue{{"nested__foo", "x"}, {"nested__foo___merge__collect___int", "1"}}, `{"nested":{"foo":["x",1]}}`, []string{}},
+	{[]ExpValue{{"foo", "x"}, {"foo__I0___merge__last", "y"}}, `{"foo":["y"]}`, []string{}},
+	{[]ExpValue{{"foo__I0", "x"}, {"foo__I0___merge__last", "y"}}, `{"foo":["y"]}`, []string{}},
 	{[]ExpValue{{"foo___time__UnixDate", "Fri Jun  9 22:21:17 CEST 2023"}}, `{"foo":"2023-06-09T20:21:17.000Z"}`, []string{}},
 	{[]ExpValue{{"foo___time__UnixDate__DateTime", "Fri Jun  9 22:21:17 CEST 2023"}}, `{"foo":"2023-06-09 20:21:17"}`, []string{}},
 	{[]ExpValue{{"foo___time__UnixDate__DateTime__UTC__UTC", "Fri Jun  9 22:21:17 CEST 2023"}}, `{"foo":"2023-06-09 20:21:17"}`, []string{}},
 	{[]ExpValue{{"foo___time__UnixDate__DateTime", "Fri Jun  9 22:21:17 MST 2023"}}, `{"foo":"2023-06-10 05:21:17"}`, []string{}},
 	{[]ExpValue{{"foo___time__UnixDate__DateTime__Europe_Ljubljana", "Fri Jun  9 22:21:17 CEST 2023"}}, `{"foo":"2023-06-09 22:21:17"}`, []string{}},
 	{[]ExpValue{{"foo___time__DateTime__UnixDate__UTC__Europe_Ljubljana", "2023-06-09 22:21:17"}}, `{"foo":"Fri Jun  9 20:21:17 UTC 2023"}`, []string{}},
+	{[]ExpValue{{"foo___time__DateTime__DateTime__America_x2f_Argentina_x2f_Buenos_Aires", "2023-06-09 22:21:17"}}, `{"foo":"2023-06-09 19:21:17"}`, []string{}},
 	{[]ExpValue{{"obj___json", `{"x":1,"y":"v"}`}}, `{"obj":{"x":1,"y":"v"}}`, []string{}},
 	{[]ExpValue{{"___json", `{"x":1,"y":"v"}`}}, `{"x":1,"y":"v"}`, []string{}},
 	{[]ExpValue{{"obj___json___optional", ``}}, ``, []string{}},
 	{[]ExpValue{{"___json___optional", ``}}, ``, []string{}},
+	{[]ExpValue{{"_x40_timestamp", "x"}}, `{"@timestamp":"x"}`, []string{}},
+	{[]ExpValue{{"http_x2e_status___int", "200"}}, `{"http.status":200}`, []string{}},
+	{[]ExpValue{{"user_x2d_agent", "x"}}, `{"user-agent":"x"}`, []string{}},
+	{[]ExpValue{{"a_x5f__x5f_b", "x"}}, `{"a__b":"x"}`, []string{}},
+	{[]ExpValue{{"nested__x40_foo__bar_x2e_", "x"}}, `{"nested":{"@foo":{"bar.":"x"}}}`, []string{}},
+	{[]ExpValue{{"foo__x2e_bar", "x"}}, `{"foo":{".bar":"x"}}`, []string{}},
+	{[]ExpValue{{"foo__x78_2e_bar", "x"}}, `{"foo":{"x2e_bar":"x"}}`, []string{}},
+	{[]ExpValue{{"foo_x2e___bar", "x"}}, `{"foo.":{"bar":"x"}}`, []string{}},
+	{[]ExpValue{{"foo___time__DateTime__DateTime__x41_merica_x2f_Argentina_x2f_Buenos_Aires", "2023-06-09 22:21:17"}}, `{"foo":"2023-06-09 19:21:17"}`, []string{}},
+	{[]ExpValue{{"caf_xc3__xa9_", "x"}}, `{"café":"x"}`, []string{}},
+	{[]ExpValue{{"foo_x5F_bar___int", "1"}}, `{"foo_bar":1}`, []string{}},
+	{[]ExpValue{{"u___url", `https://example.com:8080/a%20b/c?x=1&y=2&x=3#top`}}, `{"u":{"fragment":"top","host":"example.com","path":"/a b/c","port":8080,"query":{"x":"1","y":"2"},"scheme":"https"}}`, []string{}},
+	{[]ExpValue{{"u___url__multi", `/index.html?x=1&y=2&x=3`}}, `{"u":{"path":"/index.html","query":{"x":["1","3"],"y":"2"}}}`, []string{}},
+	{[]ExpValue{{"u___url", `http://[::1]/`}}, `{"u":{"host":"::1","path":"/","scheme":"http"}}`, []string{}},
+	{[]ExpValue{{"q___query", `?a=1&b=x%20y&a=2`}}, `{"q":{"a":"1","b":"x y"}}`, []string{}},
+	{[]ExpValue{{"q___query__multi", `a=1&b=x+y&a=2`}}, `{"q":{"a":["1","2"],"b":"x y"}}`, []string{}},
+	{[]ExpValue{{"q___query___optional", ``}}, ``, []string{}},
+	{[]ExpValue{{"q___query", `a=%zz`}}, ``, []string{`q: query: invalid value: unable to parse "a=%zz" into query: invalid URL escape "%zz"`}},
+	{[]ExpValue{{"ip___ip", `::ffff:192.168.0.1`}}, `{"ip":"192.168.0.1"}`, []string{}},
+	{[]ExpValue{{"ip___ip", `2001:0db8:0000:0000:0000:0000:0000:0001`}}, `{"ip":"2001:db8::1"}`, []string{}},
+	{[]ExpValue{{"ip___ip__version__private__loopback", `10.1.2.3`}}, `{"ip":{"address":"10.1.2.3","loopback":false,"private":true,"version":4}}`, []string{}},
+	{[]ExpValue{{"ip___ip__version__loopback__global", `::1`}}, `{"ip":{"address":"::1","global":false,"loopback":true,"version":6}}`, []string{}},
+	{[]ExpValue{{"ua___useragent", `Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36`}}, `{"ua":{"bot":false,"browser":"Chrome","device":"desktop","os":"Windows","osVersion":"10.0","version":"91.0.4472.124"}}`, []string{}},
+	{[]ExpValue{{"ua___useragent", `Mozilla/5.0 (iPhone; CPU iPhone OS 16_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.5 Mobile/15E148 Safari/604.1`}}, `{"ua":{"bot":false,"browser":"Safari","device":"mobile","os":"iOS","osVersion":"16.5","version":"16.5"}}`, []string{}},
+	{[]ExpValue{{"ua___useragent", `Mozilla/5.0 (Linux; Android 13; SM-X200) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/114.0.0.0 Safari/537.36`}}, `{"ua":{"bot":false,"browser":"Chrome","device":"tablet","os":"Android","osVersion":"13","version":"114.0.0.0"}}`, []string{}},
+	{[]ExpValue{{"ua___useragent", `Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.2210.91`}}, `{"ua":{"bot":false,"browser":"Edge","device":"desktop","os":"macOS","osVersion":"10.15.7","version":"120.0.2210.91"}}`, []string{}},
+	{[]ExpValue{{"ua___useragent", `Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/115.0`}}, `{"ua":{"bot":false,"browser":"Firefox","device":"desktop","os":"Linux","version":"115.0"}}`, []string{}},
+	{[]ExpValue{{"ua___useragent", `Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)`}}, `{"ua":{"bot":true,"browser":"Googlebot","device":"bot","version":"2.1"}}`, []string{}},
+	{[]ExpValue{{"ua___useragent", `curl/8.1.2`}}, `{"ua":{"bot":true,"browser":"curl","device":"bot","version":"8.1.2"}}`, []string{}},
+	{[]ExpValue{{"ua___useragent", `SomeCrawler/1.0`}}, `{"ua":{"bot":true,"device":"bot"}}`, []string{}},
+	{[]ExpValue{{"email___redact", `user@example.com`}}, `{"email":"***"}`, []string{}},
+	{[]ExpValue{{"email___redact__2__4", `user@example.com`}}, `{"email":"us***.com"}`, []string{}},
+	{[]ExpValue{{"token___redact__0__4", `abcdefgh`}}, `{"token":"***efgh"}`, []string{}},
+	{[]ExpValue{{"token___redact__4__4", `abcdefgh`}}, `{"token":"***"}`, []string{}},
+	{[]ExpValue{{"email___hash", `user@example.com`}}, `{"email":"b4c9a289323b21a01c3e940f150eb9b8c542587f1abfd8f0e1cc1ffc5e475514"}`, []string{}},
+	{[]ExpValue{{"email___hash__base64", `user@example.com`}}, `{"email":"tMmiiTI7IaAcPpQPFQ65uMVCWH8av9jw4cwf/F5HVRQ="}`, []string{}},
+	{[]ExpValue{{"ip___iptruncate", `192.168.1.123`}}, `{"ip":"192.168.1.0"}`, []string{}},
+	{[]ExpValue{{"ip___iptruncate", `2001:db8:1234:5678::1`}}, `{"ip":"2001:db8:1234::"}`, []string{}},
+	{[]ExpValue{{"ip___iptruncate__16__32", `::ffff:192.168.1.123`}}, `{"ip":"192.168.0.0"}`, []string{}},
+	{[]ExpValue{{"data___base64", `aGVsbG8gd29ybGQ=`}}, `{"data":"hello world"}`, []string{}},
+	{[]ExpValue{{"data___base64__url__raw", `YT9ifmM_Pw`}}, `{"data":"a?b~c??"}`, []string{}},
+	{[]ExpValue{{"data___json___base64", `eyJhIjoxfQ==`}}, `{"data":{"a":1}}`, []string{}},
+	{[]ExpValue{{"data___base64", `aGVsbG8`}}, ``, []string{`data: base64: invalid value: unable to decode "aGVsbG8" from base64: illegal base64 data at input byte 4`}},
+	{[]ExpValue{{"data___hex", `68656c6c6f`}}, `{"data":"hello"}`, []string{}},
+	{[]ExpValue{{"data___hex", `ff68`}}, ``, []string{`data: hex: invalid value: decoded "ff68" is not valid UTF-8`}},
+	{[]ExpValue{{"data___hex__replace", `ff68`}}, `{"data":"�h"}`, []string{}},
+	{[]ExpValue{{"data___hex__keep", `ff68`}}, `{"data":"ff68"}`, []string{}},
+	{[]ExpValue{{"data___urldecode", `a%20b+c%2F`}}, `{"data":"a b c/"}`, []string{}},
+	{[]ExpValue{{"data___urldecode__path", `a%20b+c%2F`}}, `{"data":"a b+c/"}`, []string{}},
+	{[]ExpValue{{"ip___ip", `300.1.2.3`}}, ``, []string{`ip: ip: invalid value: unable to parse "300.1.2.3" into IP: ParseAddr("300.1.2.3"): IPv4 field has value >255`}},
 }
 
 func TestExpression(t *testing.T) {
@@ -87,3 +168,306 @@ func TestExpression(t *testing.T) {
 		})
 	}
 }
+
+func TestRegexOperator(t *testing.T) {
+	// We modify global Patterns before the test is marked as parallel.
+	regex2json.Patterns["testPath"] = regexp.MustCompile(`^/(?P<section>[^/]+)/(?P<id___int>\d+)(?:/(?P<rest___optional>.*))?$`)
+	regex2json.Patterns["testQuery"] = regexp.MustCompile(`(?P<params___array>[^&=]+)=`)
+
+	t.Parallel()
+
+	for i, tt := range []struct {
+		Expression string
+		Value      string
+		Expected   string
+		Error      string
+	}{
+		{"path___regex__testPath", "/users/42", `{"path":{"id":42,"section":"users"}}`, ""},
+		{"path___regex__testPath", "/users/42/edit", `{"path":{"id":42,"rest":"edit","section":"users"}}`, ""},
+		{"___regex__testPath", "/users/42", `{"id":42,"section":"users"}`, ""},
+		{"query___regex__testQuery", "a=1&b=2", `{"query":{"params":["a","b"]}}`, ""},
+		{"path___regex__testPath___optional", "", ``, ""},
+		{"path___regex__testPath", "/users/abc", ``, `path: regex: invalid value: "/users/abc" does not match pattern "testPath"`},
+		{"path___regex__testPath", "/users/99999999999999999999", ``, `path: regex: pattern "testPath": id: int: invalid value: unable to parse "99999999999999999999" into int: strconv.ParseInt: parsing "99999999999999999999": value out of range`},
+	} {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Parallel()
+
+			output := map[string]any{}
+			e, err := regex2json.NewExpression(tt.Expression)
+			require.NoError(t, err, "% -+#.1v", err)
+			err = e.Apply(output, tt.Value)
+			if tt.Error != "" {
+				assert.EqualError(t, err, tt.Error)
+				return
+			}
+			require.NoError(t, err, "% -+#.1v", err)
+			if len(output) == 0 {
+				assert.Equal(t, tt.Expected, "")
+			} else {
+				j, err := json.Marshal(output)
+				require.NoError(t, err)
+				assert.Equal(t, tt.Expected, string(j))
+			}
+		})
+	}
+}
+
+func TestRegexOperatorErrors(t *testing.T) {
+	// We modify global Patterns before the test is marked as parallel.
+	regex2json.Patterns["testSelf"] = regexp.MustCompile(`(?P<x___regex__testSelf>.*)`)
+	regex2json.Patterns["testCycleA"] = regexp.MustCompile(`(?P<x___regex__testCycleB>.*)`)
+	regex2json.Patterns["testCycleB"] = regexp.MustCompile(`(?P<y___regex__testCycleA>.*)`)
+
+	t.Parallel()
+
+	_, err := regex2json.NewExpression("foo___regex")
+	assert.EqualError(t, err, `compiling operator: "regex" for expression "foo___regex": missing argument: pattern name`)
+	_, err = regex2json.NewExpression("foo___regex__doesNotExist")
+	assert.EqualError(t, err, `compiling operator: "regex" for expression "foo___regex__doesNotExist": invalid value: unknown pattern: doesNotExist`)
+	_, err = regex2json.NewExpression("foo___regex__testSelf")
+	assert.EqualError(t, err, `compiling operator: "regex" for expression "foo___regex__testSelf": compiling expressions: pattern "testSelf": compiling operator: "regex" for expression "x___regex__testSelf": invalid value: pattern references itself: testSelf -> testSelf`)
+	_, err = regex2json.NewExpression("foo___regex__testCycleA")
+	assert.EqualError(t, err, `compiling operator: "regex" for expression "foo___regex__testCycleA": compiling expressions: pattern "testCycleA": compiling operator: "regex" for expression "x___regex__testCycleB": compiling expressions: pattern "testCycleB": compiling operator: "regex" for expression "y___regex__testCycleA": invalid value: pattern references itself: testCycleA -> testCycleB -> testCycleA`)
+}
+
+func TestRegexOperatorLibrary(t *testing.T) {
+	// We modify global Patterns and Library before the test is marked as parallel.
+	regex2json.Patterns["testLibrary"] = regexp.MustCompile(`^(?P<id___int>\d+)$`)
+	regex2json.Patterns["testLibrarySelf"] = regexp.MustCompile(`(?P<x___testRegexAlias__testLibrarySelf>.*)`)
+	regex2json.Library["testRegexAlias"] = regex2json.RegexOperator
+	regex2json.Library["testRegexWrapped"] = func(args ...string) (regex2json.Op, error) {
+		op, err := regex2json.RegexOperator(args...)
+		if err != nil {
+			return nil, err
+		}
+		return func(in any) (any, error) {
+			out, err := op(in)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]any{"wrapped": out}, nil
+		}, nil
+	}
+
+	t.Parallel()
+
+	// Operators are resolved through Library, also for the regex operator.
+	e, err := regex2json.NewExpression("foo___testRegexWrapped__testLibrary")
+	require.NoError(t, err, "% -+#.1v", err)
+	output := map[string]any{}
+	err = e.Apply(output, "42")
+	require.NoError(t, err, "% -+#.1v", err)
+	assert.Equal(t, map[string]any{"foo": map[string]any{"wrapped": map[string]any{"id": int64(42)}}}, output)
+
+	// RegexOperator under another name still detects patterns which reference themselves.
+	_, err = regex2json.NewExpression("foo___testRegexAlias__testLibrarySelf")
+	assert.ErrorContains(t, err, "pattern references itself: testLibrarySelf -> testLibrarySelf")
+}
+
+func TestParseNetworks(t *testing.T) {
+	t.Parallel()
+
+	prefixes, err := regex2json.ParseNetworks("10.1.2.3/8, ::ffff:10.8.0.0/112,::ffff:0:0/80,fc00::/7")
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("10.8.0.0/16"),
+		netip.MustParsePrefix("0.0.0.0/0"),
+		netip.MustParsePrefix("::/80"),
+		netip.MustParsePrefix("fc00::/7"),
+	}, prefixes)
+
+	_, err = regex2json.ParseNetworks("10.0.0.0/33")
+	assert.ErrorIs(t, err, regex2json.ErrInvalidValue)
+}
+
+func TestCIDROperator(t *testing.T) {
+	// We modify global Networks before the test is marked as parallel.
+	internal, err := regex2json.ParseNetworks("10.0.0.0/8, 192.168.0.0/16,fc00::/7")
+	require.NoError(t, err)
+	regex2json.Networks["testInternal"] = internal
+	vpn, err := regex2json.ParseNetworks("::ffff:10.8.0.0/112")
+	require.NoError(t, err)
+	regex2json.Networks["testVPN"] = vpn
+	// Network ranges are copied when the operator is created.
+	all, err := regex2json.ParseNetworks("::ffff:0.0.0.0/80")
+	require.NoError(t, err)
+	regex2json.Networks["testAll"] = all
+	allExpression, err := regex2json.NewExpression("all___cidr__testAll")
+	require.NoError(t, err, "% -+#.1v", err)
+	delete(regex2json.Networks, "testAll")
+
+	t.Parallel()
+
+	output := map[string]any{}
+	err = allExpression.Apply(output, "8.8.8.8")
+	require.NoError(t, err, "% -+#.1v", err)
+	assert.Equal(t, map[string]any{"all": true}, output)
+
+	for i, tt := range []struct {
+		Expression string
+		Value      string
+		Expected   string
+	}{
+		{"internal___cidr__testInternal", "10.1.2.3", `{"internal":true}`},
+		{"internal___cidr__testInternal", "::ffff:192.168.1.1", `{"internal":true}`},
+		{"internal___cidr__testInternal", "fd00::1", `{"internal":true}`},
+		{"internal___cidr__testInternal", "8.8.8.8", `{"internal":false}`},
+		{"internal___cidr__testVPN__testInternal", "10.8.1.1", `{"internal":true}`},
+		{"networks___cidr", "10.8.1.1", `{"networks":["testInternal","testVPN"]}`},
+		{"networks___cidr", "8.8.8.8", `{"networks":[]}`},
+	} {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Parallel()
+
+			output := map[string]any{}
+			e, err := regex2json.NewExpression(tt.Expression)
+			require.NoError(t, err, "% -+#.1v", err)
+			err = e.Apply(output, tt.Value)
+			require.NoError(t, err, "% -+#.1v", err)
+			j, err := json.Marshal(output)
+			require.NoError(t, err)
+			assert.Equal(t, tt.Expected, string(j))
+		})
+	}
+
+	_, err = regex2json.NewExpression("foo___cidr__doesNotExist")
+	assert.EqualError(t, err, `compiling operator: "cidr" for expression "foo___cidr__doesNotExist": invalid value: unknown network: doesNotExist`)
+}
+
+func TestHashOperatorKey(t *testing.T) {
+	// We modify global HashKeys before the test is marked as parallel.
+	regex2json.HashKeys["testKey"] = []byte("secret")
+
+	t.Parallel()
+
+	output := map[string]any{}
+	e, err := regex2json.NewExpression("email___hash__hex__testKey")
+	require.NoError(t, err, "% -+#.1v", err)
+	err = e.Apply(output, "user@example.com")
+	require.NoError(t, err, "% -+#.1v", err)
+	assert.Equal(t, map[string]any{"email": "febca656b1fa2234083628d174f250dd85728259017890916cb6ffc0712340de"}, output)
+
+	_, err = regex2json.NewExpression("email___hash__hex__doesNotExist")
+	assert.EqualError(t, err, `compiling operator: "hash" for expression "email___hash__hex__doesNotExist": invalid value: unknown key: doesNotExist`)
+	_, err = regex2json.NewExpression("email___hash__base32")
+	assert.EqualError(t, err, `compiling operator: "hash" for expression "email___hash__base32": invalid value: unknown encoding: base32`)
+}
+
+func TestObjectOperatorErrors(t *testing.T) {
+	t.Parallel()
+
+	_, err := regex2json.NewExpression("I0")
+	assert.EqualError(t, err, `compiling operator: "object" for expression "I0": invalid value: path cannot start with array segment: I0`)
+	_, err = regex2json.NewExpression("INEW__foo")
+	assert.EqualError(t, err, `compiling operator: "object" for expression "INEW__foo": invalid value: path cannot start with array segment: INEW`)
+	_, err = regex2json.NewExpression("foo__I9223372036854775807")
+	assert.EqualError(t, err, `compiling operator: "object" for expression "foo__I9223372036854775807": invalid value: array index larger than 1000: I9223372036854775807`)
+	_, err = regex2json.NewExpression("foo__I100000000")
+	assert.EqualError(t, err, `compiling operator: "object" for expression "foo__I100000000": invalid value: array index larger than 1000: I100000000`)
+	_, err = regex2json.NewExpression("foo__I99999999999999999999")
+	assert.EqualError(t, err, `compiling operator: "object" for expression "foo__I99999999999999999999": invalid value: array index larger than 1000: I99999999999999999999`)
+	_, err = regex2json.NewExpression("foo__I1000")
+	assert.NoError(t, err)
+}
+
+func TestMergeStrategyErrors(t *testing.T) {
+	t.Parallel()
+
+	_, err := regex2json.NewExpression("foo___merge")
+	assert.EqualError(t, err, `compiling operator: "merge" for expression "foo___merge": missing argument: merge strategy`)
+	_, err = regex2json.NewExpression("foo___merge__unknown")
+	assert.EqualError(t, err, `compiling operator: "merge" for expression "foo___merge__unknown": invalid value: unknown merge strategy: unknown`)
+	_, err = regex2json.NewExpression("foo___merge__first___merge__last")
+	assert.EqualError(t, err, `compiling operator: "merge" for expression "foo___merge__first___merge__last": merge strategy already set`)
+}
+
+func TestEvaluateAndMerge(t *testing.T) {
+	t.Parallel()
+
+	e, err := regex2json.NewExpression("foo__bar___int")
+	require.NoError(t, err, "% -+#.1v", err)
+	result, err := e.Evaluate("42")
+	require.NoError(t, err, "% -+#.1v", err)
+	assert.Equal(t, map[string]any{"foo": map[string]any{"bar": int64(42)}}, result)
+	assert.Equal(t, regex2json.MergeDefault, e.MergeStrategy())
+
+	e, err = regex2json.NewExpression("foo___optional___merge__collect")
+	require.NoError(t, err, "% -+#.1v", err)
+	result, err = e.Evaluate("")
+	require.NoError(t, err, "% -+#.1v", err)
+	assert.Nil(t, result)
+	assert.Equal(t, regex2json.MergeCollect, e.MergeStrategy())
+
+	e, err = regex2json.NewExpression("___int")
+	require.NoError(t, err, "% -+#.1v", err)
+	result, err = e.Evaluate("42")
+	require.NoError(t, err, "% -+#.1v", err)
+	assert.Equal(t, int64(42), result)
+	err = e.Apply(map[string]any{}, "42")
+	assert.EqualError(t, err, "unexpected type: result is not an object, but int64")
+	var eErr *regex2json.ExpressionError
+	require.ErrorAs(t, err, &eErr)
+	assert.Equal(t, "___int", eErr.Expression)
+	assert.Equal(t, "42", eErr.Value)
+	assert.Equal(t, -1, eErr.Index)
+
+	e, err = regex2json.NewExpression("foo__I2__bar")
+	require.NoError(t, err, "% -+#.1v", err)
+	result, err = e.Evaluate("x")
+	require.NoError(t, err, "% -+#.1v", err)
+	assert.Equal(t, map[string]any{"foo": []any{nil, nil, map[string]any{"bar": "x"}}}, result)
+	j, err := json.Marshal(result)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"foo":[null,null,{"bar":"x"}]}`, string(j))
+
+	e, err = regex2json.NewExpression("spans__INEW__name")
+	require.NoError(t, err, "% -+#.1v", err)
+	left := map[string]any{"spans": []any{map[string]any{"name": "a"}}}
+	for _, value := range []string{"b", "c"} {
+		result, err = e.Evaluate(value)
+		require.NoError(t, err, "% -+#.1v", err)
+		err = regex2json.Merge(left, result.(map[string]any), regex2json.MergeDefault) //nolint:forcetypeassert
+		require.NoError(t, err, "% -+#.1v", err)
+	}
+	assert.Equal(t, map[string]any{"spans": []any{map[string]any{"name": "a"}, map[string]any{"name": "b"}, map[string]any{"name": "c"}}}, left)
+
+	left = map[string]any{"foo": "x", "bar": map[string]any{"baz": "y"}}
+	right := map[string]any{"foo": "z", "bar": map[string]any{"baz": "w", "qux": "v"}}
+	err = regex2json.Merge(left, right, regex2json.MergeDefault)
+	assert.EqualError(t, err, "bar__baz: value already exist")
+	left = map[string]any{"foo": "x", "bar": map[string]any{"baz": "y"}}
+	err = regex2json.Merge(left, right, regex2json.MergeLast)
+	require.NoError(t, err, "% -+#.1v", err)
+	assert.Equal(t, map[string]any{"foo": "z", "bar": map[string]any{"baz": "w", "qux": "v"}}, left)
+}
+
+func TestExpressionError(t *testing.T) {
+	t.Parallel()
+
+	e, err := regex2json.NewExpression("foo__bar___int___merge__last___optional")
+	require.NoError(t, err, "% -+#.1v", err)
+	err = e.Apply(map[string]any{}, "x")
+	assert.EqualError(t, err, `foo__bar: int: invalid value: unable to parse "x" into int: strconv.ParseInt: parsing "x": invalid syntax`)
+	var eErr *regex2json.ExpressionError
+	require.ErrorAs(t, err, &eErr)
+	assert.Equal(t, "foo__bar___int___merge__last___optional", eErr.Expression)
+	assert.Equal(t, "int", eErr.Operator)
+	assert.Equal(t, 1, eErr.Index)
+	assert.Equal(t, []string{"foo", "bar"}, eErr.Path)
+	assert.Equal(t, "x", eErr.Value)
+	assert.ErrorIs(t, err, regex2json.ErrInvalidValue)
+
+	e, err = regex2json.NewExpression("foo__bar__baz")
+	require.NoError(t, err, "% -+#.1v", err)
+	err = e.Apply(map[string]any{"foo": map[string]any{"bar": "y"}}, "x")
+	assert.EqualError(t, err, `foo__bar: value already exist`)
+	require.ErrorAs(t, err, &eErr)
+	assert.Equal(t, "foo__bar__baz", eErr.Expression)
+	assert.Equal(t, "", eErr.Operator)
+	assert.Equal(t, -1, eErr.Index)
+	assert.Equal(t, []string{"foo", "bar"}, eErr.Path)
+	assert.Equal(t, "x", eErr.Value)
+	assert.ErrorIs(t, err, regex2json.ErrValueAlreadyExist)
+}
@@ -0,0 +1,125 @@
+package regex2json
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoIPCacheSize is the maximum number of cached lookups per operator.
+const geoIPCacheSize = 10000
+
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	AutonomousSystemNumber       uint   `maxminddb:"autonomous_system_number"`
+	AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"`
+}
+
+// GeoIPDatabase is a local MaxMind database (e.g., GeoLite2 City, Country, or ASN)
+// used by [GeoIPOperator].
+type GeoIPDatabase struct {
+	reader *maxminddb.Reader
+}
+
+// OpenGeoIPDatabase opens a local MaxMind database file (.mmdb).
+func OpenGeoIPDatabase(path string) (*GeoIPDatabase, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf(`%w: unable to open GeoIP database "%s": %w`, ErrInvalidValue, path, err)
+	}
+	return &GeoIPDatabase{
+		reader: reader,
+	}, nil
+}
+
+// Close closes the database.
+func (d *GeoIPDatabase) Close() error {
+	return d.reader.Close() //nolint:wrapcheck
+}
+
+// GeoIPDatabases is a list of databases available to [GeoIPOperator].
+var GeoIPDatabases = []*GeoIPDatabase{} //nolint:gochecknoglobals
+
+// GeoIPOperator returns the geoip operator which parses the input string
+// as IPv4 or IPv6 address and looks it up in all databases in [GeoIPDatabases].
+// The output is an object with country (ISO code), city (English name),
+// asn (int), and organization (of the autonomous system) fields.
+// Fields not found in any database are omitted. The first database
+// which has a field for the address determines its value.
+//
+// Lookups are cached.
+//
+// It does not expect any arguments.
+func GeoIPOperator(args ...string) (Op, error) {
+	if len(args) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrUnexpectedArgument, strings.Join(args, ", "))
+	}
+	if len(GeoIPDatabases) == 0 {
+		return nil, fmt.Errorf("%w: no GeoIP database", ErrInvalidValue)
+	}
+	databases := slices.Clone(GeoIPDatabases)
+	var mu sync.Mutex
+	cache := map[netip.Addr]map[string]any{}
+	return func(in any) (any, error) {
+		s, skip, err := toStringOrSkip(in)
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			return in, nil
+		}
+		a, err := parseIP(s)
+		if err != nil {
+			return nil, err
+		}
+
+		mu.Lock()
+		res, ok := cache[a]
+		mu.Unlock()
+		if ok {
+			// We return a copy because the output might be modified when merged.
+			return maps.Clone(res), nil
+		}
+
+		res = map[string]any{}
+		for _, database := range databases {
+			var record geoIPRecord
+			err := database.reader.Lookup(net.IP(a.AsSlice()), &record)
+			if err != nil {
+				return nil, fmt.Errorf(`%w: unable to lookup "%s" in GeoIP database: %w`, ErrInvalidValue, s, err)
+			}
+			if _, ok := res["country"]; !ok && record.Country.ISOCode != "" {
+				res["country"] = record.Country.ISOCode
+			}
+			if _, ok := res["city"]; !ok && record.City.Names["en"] != "" {
+				res["city"] = record.City.Names["en"]
+			}
+			if _, ok := res["asn"]; !ok && record.AutonomousSystemNumber != 0 {
+				res["asn"] = int64(record.AutonomousSystemNumber) //nolint:gosec
+			}
+			if _, ok := res["organization"]; !ok && record.AutonomousSystemOrganization != "" {
+				res["organization"] = record.AutonomousSystemOrganization
+			}
+		}
+
+		mu.Lock()
+		if len(cache) >= geoIPCacheSize {
+			clear(cache)
+		}
+		cache[a] = res
+		mu.Unlock()
+
+		return maps.Clone(res), nil
+	}, nil
+}
@@ -0,0 +1,94 @@
+package regex2json_test
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/tozd/regex2json"
+)
+
+func writeGeoIPDatabase(t *testing.T, databaseType string, records map[string]mmdbtype.Map) string {
+	t.Helper()
+
+	writer, err := mmdbwriter.New(mmdbwriter.Options{DatabaseType: databaseType, IncludeReservedNetworks: true}) //nolint:exhaustruct
+	require.NoError(t, err)
+	for network, record := range records {
+		_, n, err := net.ParseCIDR(network)
+		require.NoError(t, err)
+		err = writer.Insert(n, record)
+		require.NoError(t, err)
+	}
+
+	path := filepath.Join(t.TempDir(), databaseType+".mmdb")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = writer.WriteTo(f)
+	require.NoError(t, err)
+	return path
+}
+
+func TestGeoIPOperator(t *testing.T) {
+	// We modify global GeoIPDatabases before the test is marked as parallel.
+	cityPath := writeGeoIPDatabase(t, "GeoLite2-City", map[string]mmdbtype.Map{
+		"81.2.69.0/24": {
+			"country": mmdbtype.Map{"iso_code": mmdbtype.String("GB")},
+			"city":    mmdbtype.Map{"names": mmdbtype.Map{"en": mmdbtype.String("London")}},
+		},
+		"2001:db8::/32": {
+			"country": mmdbtype.Map{"iso_code": mmdbtype.String("SI")},
+		},
+	})
+	asnPath := writeGeoIPDatabase(t, "GeoLite2-ASN", map[string]mmdbtype.Map{
+		"81.2.69.0/24": {
+			"autonomous_system_number":       mmdbtype.Uint32(20712),
+			"autonomous_system_organization": mmdbtype.String("Andrews and Arnold Ltd"),
+		},
+	})
+	databases := []*regex2json.GeoIPDatabase{}
+	for _, path := range []string{cityPath, asnPath} {
+		database, err := regex2json.OpenGeoIPDatabase(path)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			database.Close()
+		})
+		databases = append(databases, database)
+	}
+	regex2json.GeoIPDatabases = databases
+
+	t.Parallel()
+
+	e, err := regex2json.NewExpression("geo___geoip")
+	require.NoError(t, err, "% -+#.1v", err)
+
+	for i, tt := range []struct {
+		Value    string
+		Expected string
+	}{
+		{"81.2.69.142", `{"geo":{"asn":20712,"city":"London","country":"GB","organization":"Andrews and Arnold Ltd"}}`},
+		{"81.2.69.142", `{"geo":{"asn":20712,"city":"London","country":"GB","organization":"Andrews and Arnold Ltd"}}`},
+		{"::ffff:81.2.69.1", `{"geo":{"asn":20712,"city":"London","country":"GB","organization":"Andrews and Arnold Ltd"}}`},
+		{"2001:db8::1", `{"geo":{"country":"SI"}}`},
+		{"10.0.0.1", `{"geo":{}}`},
+	} {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Parallel()
+
+			output := map[string]any{}
+			err := e.Apply(output, tt.Value)
+			require.NoError(t, err, "% -+#.1v", err)
+			j, err := json.Marshal(output)
+			require.NoError(t, err)
+			assert.Equal(t, tt.Expected, string(j))
+		})
+	}
+}
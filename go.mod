@@ -3,12 +3,19 @@ module gitlab.com/tozd/regex2json
 go 1.23
 
 require (
-	github.com/stretchr/testify v1.8.4
+	github.com/klauspost/compress v1.17.11
+	github.com/maxmind/mmdbwriter v1.0.0
+	github.com/oschwald/maxminddb-golang v1.13.1
+	github.com/stretchr/testify v1.9.0
 	github.com/tkuchiki/go-timezone v0.2.2
+	github.com/ulikunitz/xz v0.5.12
+	golang.org/x/text v0.21.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	go4.org/netipx v0.0.0-20220812043211-3cc044ffd68d // indirect
+	golang.org/x/sys v0.21.0 // indirect
 )
@@ -0,0 +1,365 @@
+package regex2json
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+//nolint:gochecknoglobals
+var (
+	jsonUnmarshalerType = reflect.TypeFor[json.Unmarshaler]()
+	textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+)
+
+// TransformInto returns an iterator over values of type T decoded from records
+// for matched lines read from in, transformed with t. Unmatched lines and lines
+// for which all values were discarded are skipped.
+//
+// Records are decoded similarly to how [encoding/json] decodes JSON objects into
+// Go values: fields of structs are matched to record's keys using json struct tags
+// (or field names, matched case-insensitively if there is no exact match), and values
+// implementing [json.Unmarshaler] or [encoding.TextUnmarshaler] (for strings,
+// e.g., [time.Time]) are decoded using them. Keys without a matching field are ignored.
+// Null values set pointers, interfaces, maps, and slices to nil and leave other values unchanged.
+//
+// Errors decoding records are [DecodeError] errors with the path of the field
+// which could not be decoded. They and errors applying expressions (see [Transformer.Records])
+// are yielded together with the zero value of T, and iteration can continue after them.
+func TransformInto[T any](t *Transformer, in io.Reader) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		for record, err := range t.Records(in) {
+			var value T
+			if err == nil && (record == nil || !record.Matched || record.Fields == nil) {
+				continue
+			} else if err == nil {
+				err = Decode(record.Fields, &value)
+				if err != nil {
+					var dErr *DecodeError
+					if errors.As(err, &dErr) {
+						dErr.Line = record.Line
+					}
+					value = *new(T)
+				}
+			}
+			if !yield(value, err) {
+				return
+			}
+		}
+	}
+}
+
+// Decode decodes record into the Go value pointed to by target.
+// See [TransformInto] for details on how records are decoded.
+func Decode(record map[string]any, target any) error {
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return fmt.Errorf("%w: target must be a non-nil pointer, not %T", ErrUnexpectedType, target)
+	}
+	return decodeValue(record, v.Elem(), []string{})
+}
+
+func decodeError(path []string, target reflect.Value, value any, err error) error {
+	return &DecodeError{
+		Path:  slices.Clone(path),
+		Type:  target.Type(),
+		Value: value,
+		Line:  0,
+		Err:   err,
+	}
+}
+
+func typeMismatch(path []string, target reflect.Value, value any) error {
+	return decodeError(path, target, value, fmt.Errorf("%w: cannot decode %T into %s", ErrTypeMismatch, value, target.Type()))
+}
+
+//nolint:gocognit,gocyclo,cyclop,funlen,exhaustive
+func decodeValue(value any, target reflect.Value, path []string) error {
+	if value == nil {
+		switch target.Kind() {
+		case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice:
+			target.SetZero()
+		}
+		return nil
+	}
+
+	if target.Kind() == reflect.Pointer {
+		if target.IsNil() {
+			target.Set(reflect.New(target.Type().Elem()))
+		}
+		return decodeValue(value, target.Elem(), path)
+	}
+
+	if target.CanAddr() {
+		if target.Addr().Type().Implements(jsonUnmarshalerType) {
+			data, err := json.Marshal(value)
+			if err != nil {
+				return decodeError(path, target, value, err)
+			}
+			err = target.Addr().Interface().(json.Unmarshaler).UnmarshalJSON(data) //nolint:forcetypeassert,errcheck
+			if err != nil {
+				return decodeError(path, target, value, err)
+			}
+			return nil
+		}
+		if s, ok := value.(string); ok && target.Addr().Type().Implements(textUnmarshalerType) {
+			err := target.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s)) //nolint:forcetypeassert,errcheck
+			if err != nil {
+				return decodeError(path, target, value, err)
+			}
+			return nil
+		}
+	}
+
+	switch target.Kind() {
+	case reflect.Interface:
+		v := reflect.ValueOf(value)
+		if !v.Type().AssignableTo(target.Type()) {
+			return typeMismatch(path, target, value)
+		}
+		target.Set(v)
+		return nil
+	case reflect.String:
+		s, ok := value.(string)
+		if !ok {
+			return typeMismatch(path, target, value)
+		}
+		target.SetString(s)
+		return nil
+	case reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return typeMismatch(path, target, value)
+		}
+		target.SetBool(b)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		switch v := value.(type) {
+		case int:
+			i = int64(v)
+		case int64:
+			i = v
+		case float64:
+			if v != math.Trunc(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+				return decodeError(path, target, value, fmt.Errorf("%w: %s does not fit into %s", ErrInvalidValue, strconv.FormatFloat(v, 'g', -1, 64), target.Type()))
+			}
+			i = int64(v)
+		default:
+			return typeMismatch(path, target, value)
+		}
+		if target.OverflowInt(i) {
+			return decodeError(path, target, value, fmt.Errorf("%w: %d overflows %s", ErrInvalidValue, i, target.Type()))
+		}
+		target.SetInt(i)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var u uint64
+		switch v := value.(type) {
+		case int:
+			if v < 0 {
+				return decodeError(path, target, value, fmt.Errorf("%w: %d overflows %s", ErrInvalidValue, v, target.Type()))
+			}
+			u = uint64(v)
+		case int64:
+			if v < 0 {
+				return decodeError(path, target, value, fmt.Errorf("%w: %d overflows %s", ErrInvalidValue, v, target.Type()))
+			}
+			u = uint64(v)
+		case float64:
+			if v != math.Trunc(v) || v < 0 || v >= math.MaxUint64 {
+				return decodeError(path, target, value, fmt.Errorf("%w: %s does not fit into %s", ErrInvalidValue, strconv.FormatFloat(v, 'g', -1, 64), target.Type()))
+			}
+			u = uint64(v)
+		default:
+			return typeMismatch(path, target, value)
+		}
+		if target.OverflowUint(u) {
+			return decodeError(path, target, value, fmt.Errorf("%w: %d overflows %s", ErrInvalidValue, u, target.Type()))
+		}
+		target.SetUint(u)
+		return nil
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		switch v := value.(type) {
+		case int:
+			f = float64(v)
+		case int64:
+			f = float64(v)
+		case float64:
+			f = v
+		default:
+			return typeMismatch(path, target, value)
+		}
+		if target.OverflowFloat(f) {
+			return decodeError(path, target, value, fmt.Errorf("%w: %s overflows %s", ErrInvalidValue, strconv.FormatFloat(f, 'g', -1, 64), target.Type()))
+		}
+		target.SetFloat(f)
+		return nil
+	case reflect.Slice:
+		a, ok := value.([]any)
+		if !ok {
+			return typeMismatch(path, target, value)
+		}
+		s := reflect.MakeSlice(target.Type(), len(a), len(a))
+		for i, e := range a {
+			err := decodeValue(e, s.Index(i), append(path, strconv.Itoa(i)))
+			if err != nil {
+				return err
+			}
+		}
+		target.Set(s)
+		return nil
+	case reflect.Array:
+		a, ok := value.([]any)
+		if !ok {
+			return typeMismatch(path, target, value)
+		}
+		if len(a) > target.Len() {
+			return decodeError(path, target, value, fmt.Errorf("%w: %d elements do not fit into %s", ErrInvalidValue, len(a), target.Type()))
+		}
+		target.SetZero()
+		for i, e := range a {
+			err := decodeValue(e, target.Index(i), append(path, strconv.Itoa(i)))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		m, ok := value.(map[string]any)
+		if !ok || target.Type().Key().Kind() != reflect.String {
+			return typeMismatch(path, target, value)
+		}
+		if target.IsNil() {
+			target.Set(reflect.MakeMapWithSize(target.Type(), len(m)))
+		}
+		for key, e := range m {
+			v := reflect.New(target.Type().Elem()).Elem()
+			err := decodeValue(e, v, append(path, key))
+			if err != nil {
+				return err
+			}
+			target.SetMapIndex(reflect.ValueOf(key).Convert(target.Type().Key()), v)
+		}
+		return nil
+	case reflect.Struct:
+		m, ok := value.(map[string]any)
+		if !ok {
+			return typeMismatch(path, target, value)
+		}
+		// We decode keys in sorted order so that errors are deterministic.
+		keys := make([]string, 0, len(m))
+		for key := range m {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		fields := structFields(target.Type())
+		for _, key := range keys {
+			// We prefer an exact match and then the first case-insensitive match.
+			i := slices.IndexFunc(fields, func(f structField) bool {
+				return f.name == key
+			})
+			if i < 0 {
+				i = slices.IndexFunc(fields, func(f structField) bool {
+					return strings.EqualFold(f.name, key)
+				})
+			}
+			if i < 0 {
+				continue
+			}
+			field, err := fieldByIndex(target, fields[i].index)
+			if err != nil {
+				return decodeError(append(path, key), target, m[key], err)
+			}
+			err = decodeValue(m[key], field, append(path, key))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return typeMismatch(path, target, value)
+}
+
+type structField struct {
+	name  string
+	index []int
+}
+
+// structFields returns names and indices of exported fields of struct type typ,
+// in declaration order. Names are determined from json struct tags. Fields of
+// embedded structs are included, unless shadowed.
+func structFields(typ reflect.Type) []structField {
+	fields := []structField{}
+	var add func(typ reflect.Type, index []int)
+	add = func(typ reflect.Type, index []int) {
+		for i := range typ.NumField() {
+			field := typ.Field(i)
+			tag := field.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, _, _ := strings.Cut(tag, ",")
+			fieldIndex := append(slices.Clone(index), i)
+			fieldType := field.Type
+			if fieldType.Kind() == reflect.Pointer {
+				fieldType = fieldType.Elem()
+			}
+			if field.Anonymous && name == "" && fieldType.Kind() == reflect.Struct {
+				add(fieldType, fieldIndex)
+				continue
+			}
+			if !field.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			// Less nested fields shadow more nested fields.
+			j := slices.IndexFunc(fields, func(f structField) bool {
+				return f.name == name
+			})
+			if j >= 0 {
+				if len(fields[j].index) <= len(fieldIndex) {
+					continue
+				}
+				fields = slices.Delete(fields, j, j+1)
+			}
+			fields = append(fields, structField{name: name, index: fieldIndex})
+		}
+	}
+	add(typ, nil)
+	// Fields are added depth-first, so sorting by index restores declaration order.
+	slices.SortFunc(fields, func(a, b structField) int {
+		return slices.Compare(a.index, b.index)
+	})
+	return fields
+}
+
+// fieldByIndex returns the nested field of struct v, allocating
+// nil pointers to embedded structs.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, fmt.Errorf("%w: cannot set embedded pointer to unexported struct %s", ErrUnexpectedType, v.Type().Elem())
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, nil
+}
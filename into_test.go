@@ -0,0 +1,156 @@
+package regex2json_test
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/tozd/regex2json"
+)
+
+type testHTTP struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+}
+
+type testBase struct {
+	Level string `json:"level"`
+}
+
+type testRecord struct {
+	testBase
+
+	Time   time.Time `json:"time"`
+	Status uint16    `json:"status"`
+	HTTP   *testHTTP `json:"http"`
+	Tags   []string  `json:"tags"`
+	Size   float64
+	Extra  any    `json:"extra,omitempty"`
+	Ignore string `json:"-"`
+}
+
+func TestTransformInto(t *testing.T) {
+	t.Parallel()
+
+	tr := newTransformer(regexp.MustCompile(
+		`^(?P<time___time__RFC3339>\S+) (?P<level>\S+) (?P<http__method>\S+) (?P<http__path>\S+) (?P<status___int>\S+) (?P<size___float>\S+) (?P<tags__INEW>\S+) (?P<tags__INEW___optional>\S*)\s?(?P<Ignore>.*)$`,
+	))
+
+	in := strings.NewReader("" +
+		"2023-06-13T11:26:45Z info GET /index 200 1.5 a b x\n" +
+		"unmatched\n" +
+		"2023-06-13T11:26:46Z warn POST /form 99999 2 c  y\n" +
+		"2023-06-13T11:26:47Z error GET / 500 0 d e z\n")
+
+	values := []testRecord{}
+	errs := []error{}
+	for value, err := range regex2json.TransformInto[testRecord](tr, in) {
+		values = append(values, value)
+		errs = append(errs, err)
+	}
+
+	require.Len(t, values, 3)
+	assert.Equal(t, testRecord{
+		testBase: testBase{Level: "info"},
+		Time:     time.Date(2023, 6, 13, 11, 26, 45, 0, time.UTC),
+		Status:   200,
+		HTTP:     &testHTTP{Method: "GET", Path: "/index"},
+		Tags:     []string{"a", "b"},
+		Size:     1.5,
+		Extra:    nil,
+		Ignore:   "",
+	}, values[0])
+	require.NoError(t, errs[0])
+
+	assert.Equal(t, testRecord{}, values[1]) //nolint:exhaustruct
+	var dErr *regex2json.DecodeError
+	require.ErrorAs(t, errs[1], &dErr)
+	assert.Equal(t, []string{"status"}, dErr.Path)
+	assert.Equal(t, 3, dErr.Line)
+	assert.Equal(t, int64(99999), dErr.Value)
+	assert.ErrorIs(t, errs[1], regex2json.ErrInvalidValue)
+	assert.EqualError(t, errs[1], "status: invalid value: 99999 overflows uint16")
+
+	assert.Equal(t, "error", values[2].Level)
+	assert.Equal(t, []string{"d", "e"}, values[2].Tags)
+	require.NoError(t, errs[2])
+}
+
+func TestDecode(t *testing.T) {
+	t.Parallel()
+
+	var value struct {
+		Counts map[string]int `json:"counts"`
+		Pair   [2]bool        `json:"pair"`
+		Any    any            `json:"any"`
+	}
+	err := regex2json.Decode(map[string]any{
+		"counts": map[string]any{"a": int64(1), "b": float64(2)},
+		"pair":   []any{true},
+		"any":    []any{"x"},
+		"other":  "ignored",
+	}, &value)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"a": 1, "b": 2}, value.Counts)
+	assert.Equal(t, [2]bool{true, false}, value.Pair)
+	assert.Equal(t, []any{"x"}, value.Any)
+
+	// Like encoding/json, null leaves non-pointer values unchanged
+	// and sets pointers, interfaces, maps, and slices to nil.
+	err = regex2json.Decode(map[string]any{
+		"counts": nil,
+		"pair":   nil,
+		"any":    nil,
+	}, &value)
+	require.NoError(t, err)
+	assert.Nil(t, value.Counts)
+	assert.Equal(t, [2]bool{true, false}, value.Pair)
+	assert.Nil(t, value.Any)
+
+	// Fields are matched case-insensitively in declaration order, after an exact match.
+	var fields struct {
+		ID    string
+		Id    string //nolint:revive,stylecheck
+		Other string `json:"other"`
+	}
+	for range 10 {
+		err = regex2json.Decode(map[string]any{"id": "a", "OTHER": "b"}, &fields)
+		require.NoError(t, err)
+		assert.Equal(t, "a", fields.ID)
+		assert.Empty(t, fields.Id)
+		assert.Equal(t, "b", fields.Other)
+	}
+	err = regex2json.Decode(map[string]any{"Id": "c"}, &fields)
+	require.NoError(t, err)
+	assert.Equal(t, "c", fields.Id)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	t.Parallel()
+
+	var value struct {
+		Items []struct {
+			Count int `json:"count"`
+		} `json:"items"`
+	}
+	err := regex2json.Decode(map[string]any{
+		"items": []any{
+			map[string]any{"count": int64(1)},
+			map[string]any{"count": "two"},
+		},
+	}, &value)
+	var dErr *regex2json.DecodeError
+	require.ErrorAs(t, err, &dErr)
+	assert.Equal(t, []string{"items", "1", "count"}, dErr.Path)
+	assert.Equal(t, "int", dErr.Type.String())
+	assert.Equal(t, "two", dErr.Value)
+	assert.ErrorIs(t, err, regex2json.ErrTypeMismatch)
+	assert.EqualError(t, err, "items.1.count: type mismatch: cannot decode string into int")
+
+	err = regex2json.Decode(map[string]any{}, value)
+	assert.ErrorIs(t, err, regex2json.ErrUnexpectedType)
+}
@@ -0,0 +1,157 @@
+package regex2json
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// IPProperties is a map of properties supported by [IPOperator].
+var IPProperties = map[string]func(netip.Addr) any{ //nolint:gochecknoglobals
+	"version": func(a netip.Addr) any {
+		if a.Is4() {
+			return int64(4) //nolint:mnd
+		}
+		return int64(6) //nolint:mnd
+	},
+	"private":     func(a netip.Addr) any { return a.IsPrivate() },
+	"loopback":    func(a netip.Addr) any { return a.IsLoopback() },
+	"multicast":   func(a netip.Addr) any { return a.IsMulticast() },
+	"linklocal":   func(a netip.Addr) any { return a.IsLinkLocalUnicast() || a.IsLinkLocalMulticast() },
+	"unspecified": func(a netip.Addr) any { return a.IsUnspecified() },
+	"global":      func(a netip.Addr) any { return a.IsGlobalUnicast() && !a.IsPrivate() },
+}
+
+// Networks is a map of named network ranges available to [CIDROperator].
+var Networks = map[string][]netip.Prefix{} //nolint:gochecknoglobals
+
+func parseIP(s string) (netip.Addr, error) {
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf(`%w: unable to parse "%s" into IP: %w`, ErrInvalidValue, s, err)
+	}
+	// We normalize IPv4-mapped IPv6 addresses to IPv4 addresses.
+	return a.Unmap(), nil
+}
+
+// IPOperator returns the ip operator which parses the input string
+// as IPv4 or IPv6 address using [netip.ParseAddr] and formats it back
+// into its normalized representation (e.g., IPv4-mapped IPv6 addresses are
+// converted to IPv4 addresses, IPv6 addresses use zero compression).
+//
+// It accepts any number of arguments, names of properties from [IPProperties].
+// If any is provided, the output is an object with address field with the normalized
+// address and a field for every property (e.g., version, private, loopback).
+func IPOperator(args ...string) (Op, error) {
+	for _, arg := range args {
+		if _, ok := IPProperties[arg]; !ok {
+			return nil, fmt.Errorf("%w: unknown property: %s", ErrInvalidValue, arg)
+		}
+	}
+	return func(in any) (any, error) {
+		s, skip, err := toStringOrSkip(in)
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			return in, nil
+		}
+		a, err := parseIP(s)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) == 0 {
+			return a.String(), nil
+		}
+		res := map[string]any{
+			"address": a.String(),
+		}
+		for _, arg := range args {
+			res[arg] = IPProperties[arg](a)
+		}
+		return res, nil
+	}, nil
+}
+
+// CIDROperator returns the cidr operator which parses the input string
+// as IPv4 or IPv6 address and tests its membership in named network
+// ranges from [Networks].
+//
+// It accepts any number of arguments, names of network ranges from [Networks].
+// If any is provided, the output is a bool, true if the address belongs
+// to any of the named network ranges. Otherwise the output is an array of
+// names of all network ranges from [Networks] the address belongs to.
+//
+// Network ranges are copied when the operator is created, so later changes
+// to [Networks] do not affect it.
+func CIDROperator(args ...string) (Op, error) {
+	for _, arg := range args {
+		if _, ok := Networks[arg]; !ok {
+			return nil, fmt.Errorf("%w: unknown network: %s", ErrInvalidValue, arg)
+		}
+	}
+	networks := make(map[string][]netip.Prefix, len(Networks))
+	for name, prefixes := range Networks {
+		networks[name] = slices.Clone(prefixes)
+	}
+	return func(in any) (any, error) {
+		s, skip, err := toStringOrSkip(in)
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			return in, nil
+		}
+		a, err := parseIP(s)
+		if err != nil {
+			return nil, err
+		}
+		contains := func(name string) bool {
+			for _, prefix := range networks[name] {
+				if prefix.Contains(a) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(args) > 0 {
+			return slices.ContainsFunc(args, contains), nil
+		}
+		names := []string{}
+		for name := range networks {
+			if contains(name) {
+				names = append(names, name)
+			}
+		}
+		slices.Sort(names)
+		res := make([]any, 0, len(names))
+		for _, name := range names {
+			res = append(res, name)
+		}
+		return res, nil
+	}, nil
+}
+
+// ParseNetworks parses a comma-separated list of network ranges
+// in CIDR notation (e.g., "10.0.0.0/8,fc00::/7").
+func ParseNetworks(s string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, p := range strings.Split(s, ",") {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(p))
+		if err != nil {
+			return nil, fmt.Errorf(`%w: unable to parse "%s" into network: %w`, ErrInvalidValue, p, err)
+		}
+		// We normalize IPv4-mapped IPv6 prefixes to IPv4 prefixes, because addresses
+		// are unmapped before they are tested. Shorter IPv6 prefixes can contain all
+		// IPv4-mapped addresses, in which case we add a prefix with all IPv4 addresses.
+		prefix = prefix.Masked()
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96).Masked() //nolint:mnd
+		} else if prefix.Addr().Is6() && prefix.Contains(netip.AddrFrom16([16]byte{10: 0xff, 11: 0xff})) {
+			prefixes = append(prefixes, netip.PrefixFrom(netip.IPv4Unspecified(), 0))
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
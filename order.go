@@ -0,0 +1,114 @@
+package regex2json
+
+import (
+	"slices"
+	"strings"
+)
+
+// FieldOrder is the order of fields in records, used by [RecordEncoder] encoders.
+// It is a tree: every field can have the order of fields of its nested object.
+// Objects in arrays use the order of the field of the array.
+//
+// Fields not in the order are encoded after ordered fields, sorted alphabetically.
+// A nil FieldOrder sorts all fields alphabetically.
+type FieldOrder struct {
+	keys   []string
+	fields map[string]*FieldOrder
+}
+
+// NewFieldOrder returns an empty FieldOrder.
+func NewFieldOrder() *FieldOrder {
+	return &FieldOrder{
+		keys:   []string{},
+		fields: map[string]*FieldOrder{},
+	}
+}
+
+// ParseFieldOrder parses a comma-separated list of fields, with keys of nested
+// objects joined with [FlattenSeparator] (e.g., time,msg,http.method), into FieldOrder.
+//
+// Like in expressions (see [Expression]), any byte in keys can be written as an escape
+// _xHH_, e.g., http_x2e_status is the key http.status and a_x2c_b is the key a,b.
+func ParseFieldOrder(fields string) *FieldOrder {
+	o := NewFieldOrder()
+	for _, field := range strings.Split(escapeExpression(fields), ",") {
+		if field != "" {
+			path := strings.Split(field, FlattenSeparator)
+			for i, key := range path {
+				path[i] = unescapeExpression(key)
+			}
+			o.Add(path...)
+		}
+	}
+	return o
+}
+
+// Add adds the field at path after already added fields. Fields already
+// added keep their position. Array segments in path (see [ObjectOperator])
+// are skipped.
+func (o *FieldOrder) Add(path ...string) {
+	keys := make([]string, 0, len(path))
+	for _, key := range path {
+		if _, ok, _ := parseArraySegment(key); !ok {
+			keys = append(keys, key)
+		}
+	}
+	o.add(keys)
+}
+
+// add is like Add, but it does not skip array segments.
+func (o *FieldOrder) add(path []string) {
+	for _, key := range path {
+		field, ok := o.fields[key]
+		if !ok {
+			field = NewFieldOrder()
+			o.keys = append(o.keys, key)
+			o.fields[key] = field
+		}
+		o = field
+	}
+}
+
+// Keys returns keys of the object in order.
+func (o *FieldOrder) Keys(object map[string]any) []string {
+	keys := make([]string, 0, len(object))
+	if o != nil {
+		for _, key := range o.keys {
+			if _, ok := object[key]; ok {
+				keys = append(keys, key)
+			}
+		}
+	}
+	rest := make([]string, 0, len(object)-len(keys))
+	for key := range object {
+		if o == nil || o.fields[key] == nil {
+			rest = append(rest, key)
+		}
+	}
+	slices.Sort(rest)
+	return append(keys, rest...)
+}
+
+// Field returns the order of fields of the nested object under key.
+// It returns nil if there is no such order.
+func (o *FieldOrder) Field(key string) *FieldOrder {
+	if o == nil {
+		return nil
+	}
+	return o.fields[key]
+}
+
+// Clone returns a deep copy of the FieldOrder.
+func (o *FieldOrder) Clone() *FieldOrder {
+	if o == nil {
+		return nil
+	}
+	res := &FieldOrder{
+		keys:   slices.Clone(o.keys),
+		fields: make(map[string]*FieldOrder, len(o.fields)),
+	}
+	for key, field := range o.fields {
+		res.fields[key] = field.Clone()
+	}
+	return res
+}
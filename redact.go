@@ -0,0 +1,174 @@
+package regex2json
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// RedactMask is the mask used by [RedactOperator] in place of redacted characters.
+const RedactMask = "***"
+
+// HashKeys is a map of named keys available to [HashOperator].
+var HashKeys = map[string][]byte{} //nolint:gochecknoglobals
+
+func parseNonNegativeInt(arg string) (int, error) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%w: not a non-negative integer: %s", ErrInvalidValue, arg)
+	}
+	return n, nil
+}
+
+// RedactOperator returns the redact operator which replaces the input string
+// with [RedactMask].
+//
+// It accepts two optional arguments, in order:
+//
+//   - number of leading characters to keep (default 0)
+//   - number of trailing characters to keep (default 0)
+//
+// When the input string is not longer than the number of characters
+// to keep, the whole string is replaced.
+func RedactOperator(args ...string) (Op, error) {
+	if len(args) > 2 { //nolint:mnd
+		return nil, fmt.Errorf("%w: %s", ErrUnexpectedArgument, strings.Join(args[2:], ", "))
+	}
+	leading := 0
+	trailing := 0
+	var err error
+	if len(args) > 0 {
+		leading, err = parseNonNegativeInt(args[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(args) > 1 {
+		trailing, err = parseNonNegativeInt(args[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return func(in any) (any, error) {
+		s, skip, err := toStringOrSkip(in)
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			return in, nil
+		}
+		runes := []rune(s)
+		if len(runes) <= leading+trailing {
+			return RedactMask, nil
+		}
+		return string(runes[:leading]) + RedactMask + string(runes[len(runes)-trailing:]), nil
+	}, nil
+}
+
+// HashOperator returns the hash operator which hashes the input string
+// using SHA-256 or, if key is provided, HMAC-SHA-256.
+//
+// It accepts two optional arguments, in order:
+//
+//   - output encoding, hex or base64 (default hex)
+//   - name of the key from [HashKeys]
+func HashOperator(args ...string) (Op, error) {
+	if len(args) > 2 { //nolint:mnd
+		return nil, fmt.Errorf("%w: %s", ErrUnexpectedArgument, strings.Join(args[2:], ", "))
+	}
+	encode := hex.EncodeToString
+	if len(args) > 0 {
+		switch args[0] {
+		case "hex":
+		case "base64":
+			encode = base64.StdEncoding.EncodeToString
+		default:
+			return nil, fmt.Errorf("%w: unknown encoding: %s", ErrInvalidValue, args[0])
+		}
+	}
+	newHash := sha256.New
+	if len(args) > 1 {
+		key, ok := HashKeys[args[1]]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown key: %s", ErrInvalidValue, args[1])
+		}
+		newHash = func() hash.Hash {
+			return hmac.New(sha256.New, key)
+		}
+	}
+	return func(in any) (any, error) {
+		s, skip, err := toStringOrSkip(in)
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			return in, nil
+		}
+		h := newHash()
+		_, _ = h.Write([]byte(s))
+		return encode(h.Sum(nil)), nil
+	}, nil
+}
+
+// IPTruncateOperator returns the iptruncate operator which parses the input string
+// as IPv4 or IPv6 address and zeroes its trailing bits, formatting it back into
+// its normalized representation. E.g., with defaults, 192.168.1.123 becomes 192.168.1.0.
+//
+// It accepts two optional arguments, in order:
+//
+//   - number of leading bits to keep for IPv4 addresses (default 24)
+//   - number of leading bits to keep for IPv6 addresses (default 48)
+func IPTruncateOperator(args ...string) (Op, error) {
+	if len(args) > 2 { //nolint:mnd
+		return nil, fmt.Errorf("%w: %s", ErrUnexpectedArgument, strings.Join(args[2:], ", "))
+	}
+	bits4 := 24 //nolint:mnd
+	bits6 := 48 //nolint:mnd
+	var err error
+	if len(args) > 0 {
+		bits4, err = parseNonNegativeInt(args[0])
+		if err != nil {
+			return nil, err
+		}
+		if bits4 > 32 { //nolint:mnd
+			return nil, fmt.Errorf("%w: IPv4 bits larger than 32: %d", ErrInvalidValue, bits4)
+		}
+	}
+	if len(args) > 1 {
+		bits6, err = parseNonNegativeInt(args[1])
+		if err != nil {
+			return nil, err
+		}
+		if bits6 > 128 { //nolint:mnd
+			return nil, fmt.Errorf("%w: IPv6 bits larger than 128: %d", ErrInvalidValue, bits6)
+		}
+	}
+	return func(in any) (any, error) {
+		s, skip, err := toStringOrSkip(in)
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			return in, nil
+		}
+		a, err := parseIP(s)
+		if err != nil {
+			return nil, err
+		}
+		bits := bits6
+		if a.Is4() {
+			bits = bits4
+		}
+		// Zone is not supported by Prefix, so we remove it.
+		prefix, err := a.WithZone("").Prefix(bits)
+		if err != nil {
+			return nil, fmt.Errorf(`%w: unable to truncate "%s": %w`, ErrInvalidValue, s, err)
+		}
+		return prefix.Addr().String(), nil
+	}, nil
+}
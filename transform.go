@@ -2,16 +2,26 @@ package regex2json
 
 import (
 	"bufio"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"iter"
 	"log"
 	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
 )
 
 // CompileExpressions compiles all names of named capture groups into a slice of Expressions.
 // The Expression at index 0 is nil and should be skipped as it corresponds to the entire regexp match.
 func CompileExpressions(r *regexp.Regexp) ([]*Expression, error) {
+	return compiler{strategy: MergeDefault, patterns: nil}.compileExpressions(r, nil)
+}
+
+func (c compiler) compileExpressions(r *regexp.Regexp, aliases map[string]string) ([]*Expression, error) {
 	expressions := make([]*Expression, 0)
 
 	for i, expression := range r.SubexpNames() {
@@ -25,7 +35,11 @@ func CompileExpressions(r *regexp.Regexp) ([]*Expression, error) {
 			return nil, fmt.Errorf("%w: expression missing", ErrInvalidCaptureGroup)
 		}
 
-		s, err := NewExpression(expression)
+		if alias, ok := aliases[expression]; ok {
+			expression = alias
+		}
+
+		s, err := c.newExpression(expression)
 		if err != nil {
 			return nil, err
 		}
@@ -35,80 +49,532 @@ func CompileExpressions(r *regexp.Regexp) ([]*Expression, error) {
 	return expressions, nil
 }
 
-// Transform reads lines from in, matching every line with regexp r. If line matches, values from
-// captured named groups are mapped into output JSON which is then written out to matched writer.
-// If the line does not match, it is written to unmatched writer.
+// errorToJSON converts an error applying expression to value into an object.
+func errorToJSON(expression *Expression, value string, err error) map[string]any {
+	res := map[string]any{
+		"expression": expression.String(),
+		"value":      value,
+		"message":    err.Error(),
+	}
+	var eErr *ExpressionError
+	if errors.As(err, &eErr) {
+		if len(eErr.Path) > 0 {
+			res["field"] = strings.Join(eErr.Path, "__")
+		}
+		if eErr.Operator != "" {
+			res["operator"] = eErr.Operator
+		}
+		res["message"] = eErr.Err.Error()
+	}
+	return res
+}
+
+// MetadataKeys are keys under which metadata about the line is added to the output JSON.
+// Metadata does not override values produced by expressions under the same keys.
+type MetadataKeys struct {
+	// Line is the key for the line number, starting with 1.
+	Line string
+
+	// Offset is the key for the byte offset of the start of the line in the input.
+	// If the input has an Offset method, offsets start at the offset it returns
+	// (e.g., when the input is a file read from the middle) instead of at 0.
+	Offset string
+
+	// Source is the key for the name of the input, if the input has a Name method
+	// (e.g., [os.File]).
+	Source string
+
+	// Time is the key for the time when the line was read, in RFC 3339 format.
+	Time string
+
+	// Raw is the key for the raw line.
+	Raw string
+
+	// Regexp is the key for the regexp which matched the line.
+	// It is not added for unmatched lines.
+	Regexp string
+}
+
+// Transformer reads lines, matching every line with its regexp. If line matches, values from
+// captured named groups are mapped into output JSON.
 //
 // Capture groups' names are compiled into Expressions and describe how are matched values mapped
 // and transformed into output JSON. See [Expression] for details on the syntax and [Library] for
 // available operators.
 //
-// If logger is provided, any error (e.g., a failed expression) is logged to it while the rest
-// of the output JSON is still written out.
-// If logger is not provided, the error is returned as error of the function, aborting the transformation.
-//
-// If regexp r can match multiple times per line, all matches are combined together into
-// the same ome JSON output per line.
-func Transform(r *regexp.Regexp, in io.Reader, matched, unmatched io.Writer, logger *log.Logger) error {
-	expressions, err := CompileExpressions(r)
+// Transformer should not be modified after it has been used.
+type Transformer struct {
+	// Regexp used to match lines.
+	Regexp *regexp.Regexp
+
+	// Aliases is a map between capture groups' names and expressions used instead
+	// of those names. This allows regexp to use short names for long expressions.
+	Aliases map[string]string
+
+	// MergeStrategy is used for expressions which do not set their own merge strategy.
+	// By default, merging conflicting values fails with an error.
+	MergeStrategy MergeStrategy
+
+	// If ErrorsKey is set, errors applying expressions are added to the output JSON under
+	// this key as an array of objects with field, expression, operator, value, and message
+	// fields, instead of being logged or returned.
+	ErrorsKey string
+
+	// If UnmatchedKey is set, unmatched lines are written to the unmatched writer as JSON
+	// objects with the line under this key, instead of as raw lines.
+	UnmatchedKey string
+
+	// If UnmatchedFlagKey is set together with UnmatchedKey, JSON objects for unmatched lines
+	// also have this key set to true, so that they can be distinguished from matched lines.
+	UnmatchedFlagKey string
+
+	// If Encoding is set, input is decoded from it into UTF-8 before lines are matched.
+	// Metadata byte offsets are then offsets in the decoded input.
+	Encoding encoding.Encoding
+
+	// InvalidUTF8 determines what is done with lines with invalid UTF-8.
+	// By default, invalid bytes are kept and replaced with U+FFFD in the output JSON.
+	InvalidUTF8 UTF8Policy
+
+	// MetadataKeys configures under which keys is metadata about the line added to
+	// the output JSON. Metadata is not added for keys which are not set.
+	MetadataKeys MetadataKeys
+
+	// If OrderFields is set, fields of records are encoded in the order of capture groups
+	// in the regexp (and in patterns used by the regex operator, for fields they produce),
+	// followed by the errors key, unmatched keys, and metadata keys.
+	// By default, fields are sorted alphabetically.
+	OrderFields bool
+
+	// FieldOrder is the order of fields of records, used before the order of
+	// capture groups (if OrderFields is set).
+	FieldOrder *FieldOrder
+
+	// Encoder is used to create encoders for output JSON written to matched writer
+	// and for unmatched lines wrapped into JSON written to unmatched writer.
+	// Encoders are created for every call to [Transformer.Transform].
+	// By default, [NewJSONEncoder] is used.
+	Encoder func(w io.Writer) RecordEncoder
+
+	// If Logger is provided, any error (e.g., a failed expression) is logged to it
+	// while the rest of the output JSON is still written out.
+	// If Logger is not provided, the error is returned, aborting the transformation.
+	Logger *log.Logger
+}
+
+// CompiledTransformer is a [Transformer] with compiled expressions.
+// It can be used to transform many inputs or lines without compiling
+// expressions again. Create it using [Transformer.Compile].
+type CompiledTransformer struct {
+	transformer Transformer
+	expressions []*Expression
+}
+
+// Compile compiles expressions of the Transformer and returns CompiledTransformer.
+// The Transformer is copied, so later changes to it do not affect CompiledTransformer.
+func (t *Transformer) Compile() (*CompiledTransformer, error) {
+	expressions, err := compiler{strategy: t.MergeStrategy, patterns: nil}.compileExpressions(t.Regexp, t.Aliases)
 	if err != nil {
-		return fmt.Errorf("%w: %w", ErrCompilingExpressions, err)
+		return nil, fmt.Errorf("%w: %w", ErrCompilingExpressions, err)
 	}
+	return &CompiledTransformer{
+		transformer: *t,
+		expressions: expressions,
+	}, nil
+}
 
-	encoder := json.NewEncoder(matched)
-	encoder.SetEscapeHTML(false)
+// Record is the result of transforming one line.
+type Record struct {
+	// Line is the line number, starting with 1.
+	// It is 0 for lines transformed with [CompiledTransformer.TransformLine].
+	Line int
 
-	scanner := bufio.NewScanner(in)
+	// Offset is the byte offset of the start of the line in the input.
+	Offset int64
 
-	for scanner.Scan() {
-		line := scanner.Bytes()
-		if len(line) > 0 {
-			output := map[string]any{}
+	// Raw is the line itself, after invalid UTF-8 has been handled.
+	Raw string
 
-			matches := r.FindAllSubmatch(line, -1)
-			if len(matches) == 0 {
-				_, err := unmatched.Write(append(line, '\n'))
-				if err != nil {
-					if logger != nil {
-						logger.Printf(`failed to write unmatched line "%s": %s`, line, err)
-					} else {
-						return fmt.Errorf(`failed to write unmatched line "%s": %w`, line, err)
-					}
-				}
+	// Matched is true if the line matched the regexp.
+	Matched bool
+
+	// Fields is the output JSON of the line, with any configured metadata.
+	// It is nil if the line matched but all values were discarded.
+	// For unmatched lines, it is the line wrapped into JSON if UnmatchedKey is set,
+	// and nil otherwise.
+	Fields map[string]any
+}
+
+// Records returns an iterator over records for lines read from in.
+// Empty lines are skipped.
+//
+// Errors applying expressions are yielded together with the record for the line
+// (with nil Fields), unless ErrorsKey or Logger is set. Iteration can continue after them.
+// They are [ExpressionError] errors with the line number set.
+// After an error reading input ([ErrReadingInput]) or compiling expressions, iteration stops.
+func (t *Transformer) Records(in io.Reader) iter.Seq2[*Record, error] {
+	return func(yield func(*Record, error) bool) {
+		c, err := t.Compile()
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		for record, err := range c.Records(in) {
+			if !yield(record, err) {
+				return
+			}
+		}
+	}
+}
+
+// Records is like [Transformer.Records], but uses already compiled expressions.
+func (c *CompiledTransformer) Records(in io.Reader) iter.Seq2[*Record, error] {
+	return c.transformer.records(c.expressions, in)
+}
+
+// TransformLine transforms one line, which should not contain a newline.
+// If Encoding is set, the line is first decoded from it into UTF-8.
+// Metadata for line number, offset, and source is not added.
+//
+// Errors applying expressions are returned together with the record for the line
+// (with nil Fields), unless ErrorsKey or Logger is set.
+func (c *CompiledTransformer) TransformLine(line []byte) (*Record, error) {
+	if c.transformer.Encoding != nil {
+		decoded, err := c.transformer.Encoding.NewDecoder().Bytes(line)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrReadingInput, err)
+		}
+		line = decoded
+	}
+	return c.transformer.transformLine(c.expressions, line, lineMetadata{line: 0, offset: 0, source: "", raw: nil})
+}
+
+// records returns an iterator over records for non-empty lines read from in.
+func (t *Transformer) records(expressions []*Expression, in io.Reader) iter.Seq2[*Record, error] {
+	return func(yield func(*Record, error) bool) {
+		source := ""
+		if n, ok := in.(interface{ Name() string }); ok {
+			source = n.Name()
+		}
+		var offset, lineOffset int64
+		if o, ok := in.(interface{ Offset() int64 }); ok {
+			offset = o.Offset()
+		}
+
+		if t.Encoding != nil {
+			in = transform.NewReader(in, t.Encoding.NewDecoder())
+		}
+
+		scanner := bufio.NewScanner(in)
+		scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+			advance, token, err := bufio.ScanLines(data, atEOF)
+			if token != nil {
+				lineOffset = offset
+			}
+			offset += int64(advance)
+			return advance, token, err
+		})
+
+		lineNumber := 0
+		for scanner.Scan() {
+			lineNumber++
+			line := scanner.Bytes()
+			if len(line) == 0 {
+				continue
+			}
+			record, err := t.transformLine(expressions, line, lineMetadata{
+				line:   lineNumber,
+				offset: lineOffset,
+				source: source,
+				raw:    nil,
+			})
+			if !yield(record, err) {
+				return
+			}
+		}
+
+		err := scanner.Err()
+		if err != nil {
+			yield(nil, fmt.Errorf("%w: %w", ErrReadingInput, err))
+		}
+	}
+}
+
+// transformLine matches the line with the regexp and applies expressions to matched values.
+func (t *Transformer) transformLine(expressions []*Expression, line []byte, metadata lineMetadata) (*Record, error) {
+	line, valid := fixInvalidUTF8(line, t.InvalidUTF8)
+	metadata.raw = line
+
+	record := &Record{
+		Line:    metadata.line,
+		Offset:  metadata.offset,
+		Raw:     string(line),
+		Matched: false,
+		Fields:  nil,
+	}
+
+	var matches [][][]byte
+	if valid {
+		matches = t.Regexp.FindAllSubmatch(line, -1)
+	}
+	if len(matches) == 0 {
+		if t.UnmatchedKey != "" {
+			record.Fields = t.wrapUnmatched(line, metadata)
+		}
+		return record, nil
+	}
+
+	record.Matched = true
+	output := map[string]any{}
+
+	errs := []any{}
+	for _, match := range matches {
+		for i, value := range match {
+			// Nil expressions we skip.
+			if expressions[i] == nil {
 				continue
 			}
 
-			for _, match := range matches {
-				for i, value := range match {
-					// Nil expressions we skip.
-					if expressions[i] == nil {
-						continue
-					}
-
-					v := string(value)
-
-					err := expressions[i].Apply(output, v)
-					if err != nil {
-						if logger != nil {
-							logger.Printf(`failed to apply expression "%s" for value "%s" and line "%s": %s`, expressions[i].String(), v, line, err)
-						} else {
-							return fmt.Errorf(`failed to apply expression "%s" for value "%s" and line "%s": %w`, expressions[i].String(), v, line, err)
-						}
-					}
+			v := string(value)
+
+			err := expressions[i].apply(output, v, t.MergeStrategy)
+			if err != nil {
+				var eErr *ExpressionError
+				if errors.As(err, &eErr) {
+					eErr.Line = metadata.line
+				}
+				if t.ErrorsKey != "" {
+					errs = append(errs, errorToJSON(expressions[i], v, err))
+				} else if t.Logger != nil {
+					t.Logger.Printf(`failed to apply expression "%s" for value "%s" on line %d: %s`, expressions[i].String(), v, metadata.line, err)
+				} else {
+					return record, fmt.Errorf(`failed to apply expression "%s" for value "%s" on line %d: %w`, expressions[i].String(), v, metadata.line, err)
 				}
 			}
+		}
+	}
 
-			// We do not output empty objects.
-			if len(output) == 0 {
-				continue
+	// All matches have been applied, so arrays will not be filled in anymore.
+	unpad(output)
+
+	if len(errs) > 0 {
+		err := Merge(output, map[string]any{t.ErrorsKey: errs}, MergeError)
+		if err != nil {
+			if t.Logger != nil {
+				t.Logger.Printf(`failed to add errors on line %d: %s`, metadata.line, err)
+			} else {
+				return record, fmt.Errorf(`failed to add errors on line %d: %w`, metadata.line, err)
 			}
+		}
+	}
+
+	// We do not output empty objects.
+	if len(output) == 0 {
+		return record, nil
+	}
+
+	t.addMetadata(output, metadata, true)
+	record.Fields = output
+
+	return record, nil
+}
+
+// Transform reads lines from in, matching every line with the regexp. If line matches, values from
+// captured named groups are mapped into output JSON which is then written out to matched writer.
+// If the line does not match, it is written to unmatched writer, wrapped into JSON if
+// UnmatchedKey is set. The same writer can be passed as both matched and unmatched writer.
+//
+// If the regexp can match multiple times per line, all matches are combined together into
+// the same one JSON output per line.
+//
+// Errors applying expressions are [ExpressionError] errors with the line number set.
+func (t *Transformer) Transform(in io.Reader, matched, unmatched io.Writer) error {
+	c, err := t.Compile()
+	if err != nil {
+		return err
+	}
+	return c.Transform(in, matched, unmatched)
+}
+
+// TransformWith is like [Transformer.Transform], but output JSON is encoded with encoder
+// and unmatched lines wrapped into JSON with unmatchedEncoder, instead of with encoders
+// created using Encoder. Raw unmatched lines are written to unmatched writer.
+//
+// This allows the same encoders (e.g., a CSV encoder which has already written
+// the header) to be used when transforming multiple inputs into the same output.
+func (t *Transformer) TransformWith(in io.Reader, encoder RecordEncoder, unmatched io.Writer, unmatchedEncoder RecordEncoder) error {
+	c, err := t.Compile()
+	if err != nil {
+		return err
+	}
+	return c.TransformWith(in, encoder, unmatched, unmatchedEncoder)
+}
+
+// Transform is like [Transformer.Transform], but uses already compiled expressions.
+func (c *CompiledTransformer) Transform(in io.Reader, matched, unmatched io.Writer) error {
+	newEncoder := c.transformer.Encoder
+	if newEncoder == nil {
+		newEncoder = NewJSONEncoder
+	}
+	return c.TransformWith(in, newEncoder(matched), unmatched, newEncoder(unmatched))
+}
+
+// TransformWith is like [Transformer.TransformWith], but uses already compiled expressions.
+func (c *CompiledTransformer) TransformWith(in io.Reader, encoder RecordEncoder, unmatched io.Writer, unmatchedEncoder RecordEncoder) error {
+	t := &c.transformer
+	expressions := c.expressions
 
-			err := encoder.Encode(output)
+	order := t.fieldOrder(expressions)
+
+	for record, err := range t.records(expressions, in) {
+		if err != nil {
+			return err
+		}
+
+		if !record.Matched {
+			var err error
+			if record.Fields != nil {
+				err = unmatchedEncoder.Encode(record.Fields, order)
+			} else {
+				_, err = io.WriteString(unmatched, record.Raw+"\n")
+			}
 			if err != nil {
-				return fmt.Errorf("failed to write json: %w", err)
+				if t.Logger != nil {
+					t.Logger.Printf(`failed to write unmatched line "%s": %s`, record.Raw, err)
+				} else {
+					return fmt.Errorf(`failed to write unmatched line "%s": %w`, record.Raw, err)
+				}
 			}
+			continue
+		}
+
+		if record.Fields == nil {
+			continue
+		}
+
+		err := encoder.Encode(record.Fields, order)
+		if err != nil {
+			return fmt.Errorf("failed to write record: %w", err)
 		}
 	}
 
 	return nil
 }
+
+// fieldOrder returns the order of fields for records. It returns nil
+// if fields should be sorted alphabetically.
+func (t *Transformer) fieldOrder(expressions []*Expression) *FieldOrder {
+	if !t.OrderFields {
+		return t.FieldOrder
+	}
+	order := t.FieldOrder.Clone()
+	if order == nil {
+		order = NewFieldOrder()
+	}
+	for _, expression := range expressions {
+		if expression != nil {
+			expression.addFieldOrder(order, nil)
+		}
+	}
+	for _, key := range []string{
+		t.ErrorsKey, t.UnmatchedKey, t.UnmatchedFlagKey,
+		t.MetadataKeys.Line, t.MetadataKeys.Offset, t.MetadataKeys.Source,
+		t.MetadataKeys.Time, t.MetadataKeys.Raw, t.MetadataKeys.Regexp,
+	} {
+		if key != "" {
+			order.Add(key)
+		}
+	}
+	return order
+}
+
+// wrapUnmatched wraps unmatched line into an object.
+func (t *Transformer) wrapUnmatched(line []byte, metadata lineMetadata) map[string]any {
+	res := map[string]any{
+		t.UnmatchedKey: string(line),
+	}
+	if t.UnmatchedFlagKey != "" && t.UnmatchedFlagKey != t.UnmatchedKey {
+		res[t.UnmatchedFlagKey] = true
+	}
+	t.addMetadata(res, metadata, false)
+	return res
+}
+
+// lineMetadata is metadata about the line being transformed.
+type lineMetadata struct {
+	line   int
+	offset int64
+	source string
+	raw    []byte
+}
+
+// addMetadata adds metadata to output under configured keys,
+// skipping keys which already exist in output.
+func (t *Transformer) addMetadata(output map[string]any, metadata lineMetadata, matched bool) {
+	add := func(key string, value func() any) {
+		if key == "" {
+			return
+		}
+		if _, ok := output[key]; ok {
+			return
+		}
+		output[key] = value()
+	}
+
+	// Line numbers start with 1, so 0 means that the position of the line is not known.
+	if metadata.line > 0 {
+		add(t.MetadataKeys.Line, func() any { return metadata.line })
+		add(t.MetadataKeys.Offset, func() any { return metadata.offset })
+	}
+	if metadata.source != "" {
+		add(t.MetadataKeys.Source, func() any { return metadata.source })
+	}
+	add(t.MetadataKeys.Time, func() any { return time.Now().UTC().Format(time.RFC3339Nano) })
+	add(t.MetadataKeys.Raw, func() any { return string(metadata.raw) })
+	if matched {
+		add(t.MetadataKeys.Regexp, func() any { return t.Regexp.String() })
+	}
+}
+
+// Transform reads lines from in, matching every line with regexp r. If line matches, values from
+// captured named groups are mapped into output JSON which is then written out to matched writer.
+// If the line does not match, it is written to unmatched writer.
+//
+// Capture groups' names are compiled into Expressions and describe how are matched values mapped
+// and transformed into output JSON. See [Expression] for details on the syntax and [Library] for
+// available operators.
+//
+// If logger is provided, any error (e.g., a failed expression) is logged to it while the rest
+// of the output JSON is still written out.
+// If logger is not provided, the error is returned as error of the function, aborting the transformation.
+//
+// If regexp r can match multiple times per line, all matches are combined together into
+// the same ome JSON output per line.
+//
+// Transform is a shorthand for calling [Transformer.Transform]. Use [Transformer]
+// directly for more options.
+func Transform(r *regexp.Regexp, in io.Reader, matched, unmatched io.Writer, logger *log.Logger) error {
+	t := &Transformer{
+		Regexp:           r,
+		Aliases:          nil,
+		MergeStrategy:    MergeDefault,
+		ErrorsKey:        "",
+		UnmatchedKey:     "",
+		UnmatchedFlagKey: "",
+		Encoding:         nil,
+		InvalidUTF8:      UTF8Keep,
+		MetadataKeys: MetadataKeys{
+			Line:   "",
+			Offset: "",
+			Source: "",
+			Time:   "",
+			Raw:    "",
+			Regexp: "",
+		},
+		OrderFields: false,
+		FieldOrder:  nil,
+		Encoder:     nil,
+		Logger:      logger,
+	}
+	return t.Transform(in, matched, unmatched)
+}
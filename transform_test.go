@@ -2,8 +2,11 @@ package regex2json_test
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -16,6 +19,33 @@ import (
 	"gitlab.com/tozd/regex2json"
 )
 
+// newTransformer returns a Transformer for r with all other fields set to their defaults,
+// so that tests can set only fields they test.
+func newTransformer(r *regexp.Regexp) *regex2json.Transformer {
+	return &regex2json.Transformer{
+		Regexp:           r,
+		Aliases:          nil,
+		MergeStrategy:    regex2json.MergeDefault,
+		ErrorsKey:        "",
+		UnmatchedKey:     "",
+		UnmatchedFlagKey: "",
+		Encoding:         nil,
+		InvalidUTF8:      regex2json.UTF8Keep,
+		MetadataKeys: regex2json.MetadataKeys{
+			Line:   "",
+			Offset: "",
+			Source: "",
+			Time:   "",
+			Raw:    "",
+			Regexp: "",
+		},
+		OrderFields: false,
+		FieldOrder:  nil,
+		Encoder:     nil,
+		Logger:      nil,
+	}
+}
+
 func TestTransform(t *testing.T) {
 	t.Parallel()
 
@@ -138,3 +168,365 @@ func TestLayoutWithoutYear(t *testing.T) {
 	assert.Equal(t, "", outerr.String())
 	assert.Equal(t, "", l.String())
 }
+
+func TestTransformerAliases(t *testing.T) {
+	t.Parallel()
+
+	tr := newTransformer(regexp.MustCompile(`^\[(?P<ts>[^\]]+)\] (?P<status>\d+) (?P<msg>.*)$`))
+	tr.Aliases = map[string]string{
+		"ts":     "@timestamp___time__Nginx__RFC3339",
+		"status": "http_x2e_status___int",
+	}
+	in := bytes.Buffer{}
+	_, err := in.WriteString("[13/Jun/2023:13:15:13 +0000] 200 ok\n")
+	require.NoError(t, err)
+	out := bytes.Buffer{}
+	outerr := bytes.Buffer{}
+	err = tr.Transform(&in, &out, &outerr)
+	require.NoError(t, err, "% -+#.1v", err)
+	assert.Equal(t, `{"@timestamp":"2023-06-13T13:15:13Z","http.status":200,"msg":"ok"}`+"\n", out.String())
+	assert.Equal(t, "", outerr.String())
+}
+
+func TestTransformerMergeStrategy(t *testing.T) {
+	t.Parallel()
+
+	for i, tt := range []struct {
+		Strategy regex2json.MergeStrategy
+		Expected string
+		Log      string
+	}{
+		{regex2json.MergeDefault, `{"first":"a","tag":"a"}`, "failed to apply expression \"tag\" for value \"b\" on line 1: tag: value already exist\n"},
+		{regex2json.MergeError, `{"first":"a","tag":"a"}`, "failed to apply expression \"tag\" for value \"b\" on line 1: tag: value already exist\n"},
+		{regex2json.MergeFirst, `{"first":"a","tag":"a"}`, ""},
+		{regex2json.MergeLast, `{"first":"a","tag":"b"}`, ""},
+		{regex2json.MergeCollect, `{"first":"a","tag":["a","b"]}`, ""},
+	} {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			t.Parallel()
+
+			l := bytes.Buffer{}
+			tr := newTransformer(regexp.MustCompile(`(?P<tag>(?P<first___merge__first>[a-z]))`))
+			tr.MergeStrategy = tt.Strategy
+			tr.Logger = log.New(&l, "", 0)
+			in := bytes.Buffer{}
+			_, err := in.WriteString("a b\n")
+			require.NoError(t, err)
+			out := bytes.Buffer{}
+			outerr := bytes.Buffer{}
+			err = tr.Transform(&in, &out, &outerr)
+			require.NoError(t, err, "% -+#.1v", err)
+			assert.Equal(t, tt.Expected+"\n", out.String())
+			assert.Equal(t, tt.Log, l.String())
+		})
+	}
+}
+
+func TestTransformExpressionError(t *testing.T) {
+	t.Parallel()
+
+	r := regexp.MustCompile(`^(?P<status___int>\S+)$`)
+	in := bytes.Buffer{}
+	_, err := in.WriteString("200\n\nabc\n")
+	require.NoError(t, err)
+	out := bytes.Buffer{}
+	outerr := bytes.Buffer{}
+	err = regex2json.Transform(r, &in, &out, &outerr, nil)
+	assert.EqualError(t, err, `failed to apply expression "status___int" for value "abc" on line 3: status: int: invalid value: unable to parse "abc" into int: strconv.ParseInt: parsing "abc": invalid syntax`)
+	var eErr *regex2json.ExpressionError
+	require.ErrorAs(t, err, &eErr)
+	assert.Equal(t, 3, eErr.Line)
+	assert.Equal(t, "int", eErr.Operator)
+	assert.Equal(t, []string{"status"}, eErr.Path)
+	assert.Equal(t, `{"status":200}`+"\n", out.String())
+}
+
+func TestTransformerErrorsKey(t *testing.T) {
+	t.Parallel()
+
+	l := bytes.Buffer{}
+	tr := newTransformer(regexp.MustCompile(`^(?P<status___int>\S+) (?P<msg>.+)$`))
+	tr.ErrorsKey = "_errors"
+	tr.Logger = log.New(&l, "", 0)
+	in := bytes.Buffer{}
+	_, err := in.WriteString("200 ok\nabc failed\n")
+	require.NoError(t, err)
+	out := bytes.Buffer{}
+	outerr := bytes.Buffer{}
+	err = tr.Transform(&in, &out, &outerr)
+	require.NoError(t, err, "% -+#.1v", err)
+	assert.Equal(t, `{"msg":"ok","status":200}`+"\n"+
+		`{"_errors":[{"expression":"status___int","field":"status","message":"invalid value: unable to parse \"abc\" into int: strconv.ParseInt: parsing \"abc\": invalid syntax","operator":"int","value":"abc"}],"msg":"failed"}`+"\n",
+		out.String())
+	assert.Equal(t, "", outerr.String())
+	assert.Equal(t, "", l.String())
+}
+
+func TestTransformerUnmatchedKey(t *testing.T) {
+	t.Parallel()
+
+	tr := newTransformer(regexp.MustCompile(`^(?P<status___int>\d+) (?P<msg>.+)$`))
+	tr.UnmatchedKey = "message"
+	tr.UnmatchedFlagKey = "_unmatched"
+	in := bytes.Buffer{}
+	_, err := in.WriteString("200 ok\nsomething <else>\n404 not found\n")
+	require.NoError(t, err)
+	out := bytes.Buffer{}
+	err = tr.Transform(&in, &out, &out)
+	require.NoError(t, err, "% -+#.1v", err)
+	assert.Equal(t, `{"msg":"ok","status":200}`+"\n"+
+		`{"_unmatched":true,"message":"something <else>"}`+"\n"+
+		`{"msg":"not found","status":404}`+"\n",
+		out.String())
+}
+
+func TestTransformerMetadataKeys(t *testing.T) {
+	t.Parallel()
+
+	tr := newTransformer(regexp.MustCompile(`^(?P<status___int>\d+) (?P<msg>.+)$`))
+	tr.UnmatchedKey = "msg"
+	tr.MetadataKeys.Line = "line"
+	tr.MetadataKeys.Offset = "offset"
+	tr.MetadataKeys.Source = "source"
+	tr.MetadataKeys.Raw = "raw"
+	tr.MetadataKeys.Regexp = "msg"
+	in := bytes.Buffer{}
+	_, err := in.WriteString("200 ok\r\nfoo\n\n404 not found")
+	require.NoError(t, err)
+	out := bytes.Buffer{}
+	err = tr.Transform(&in, &out, &out)
+	require.NoError(t, err, "% -+#.1v", err)
+	assert.Equal(t, `{"line":1,"msg":"ok","offset":0,"raw":"200 ok","status":200}`+"\n"+
+		`{"line":2,"msg":"foo","offset":8,"raw":"foo"}`+"\n"+
+		`{"line":4,"msg":"not found","offset":13,"raw":"404 not found","status":404}`+"\n",
+		out.String())
+}
+
+func TestTransformerMetadataTime(t *testing.T) {
+	t.Parallel()
+
+	tr := newTransformer(regexp.MustCompile(`^(?P<msg>.+)$`))
+	tr.MetadataKeys.Time = "time"
+	tr.MetadataKeys.Regexp = "regexp"
+	before := time.Now()
+	in := bytes.Buffer{}
+	_, err := in.WriteString("foo\n")
+	require.NoError(t, err)
+	out := bytes.Buffer{}
+	err = tr.Transform(&in, &out, &out)
+	require.NoError(t, err, "% -+#.1v", err)
+	var res map[string]any
+	err = json.Unmarshal(out.Bytes(), &res)
+	require.NoError(t, err)
+	assert.Equal(t, "foo", res["msg"])
+	assert.Equal(t, `^(?P<msg>.+)$`, res["regexp"])
+	require.IsType(t, "", res["time"])
+	ts, err := time.Parse(time.RFC3339Nano, res["time"].(string)) //nolint:forcetypeassert
+	require.NoError(t, err)
+	assert.False(t, ts.Before(before.Truncate(time.Second)))
+}
+
+func TestTransformerMetadataSource(t *testing.T) {
+	t.Parallel()
+
+	tr := newTransformer(regexp.MustCompile(`^(?P<msg>.+)$`))
+	tr.MetadataKeys.Source = "source"
+	path := filepath.Join(t.TempDir(), "input.log")
+	err := os.WriteFile(path, []byte("foo\n"), 0o600)
+	require.NoError(t, err)
+	in, err := os.Open(path)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		in.Close()
+	})
+	out := bytes.Buffer{}
+	err = tr.Transform(in, &out, &out)
+	require.NoError(t, err, "% -+#.1v", err)
+	source, err := json.Marshal(path)
+	require.NoError(t, err)
+	assert.Equal(t, `{"msg":"foo","source":`+string(source)+`}`+"\n", out.String())
+}
+
+type offsetReader struct {
+	*strings.Reader
+
+	offset int64
+}
+
+func (r offsetReader) Offset() int64 {
+	return r.offset
+}
+
+func TestTransformerMetadataOffset(t *testing.T) {
+	t.Parallel()
+
+	tr := newTransformer(regexp.MustCompile(`^(?P<msg>.+)$`))
+	tr.MetadataKeys.Offset = "offset"
+	out := bytes.Buffer{}
+	err := tr.Transform(offsetReader{Reader: strings.NewReader("foo\nbar\n"), offset: 100}, &out, &out)
+	require.NoError(t, err, "% -+#.1v", err)
+	assert.Equal(t, `{"msg":"foo","offset":100}`+"\n"+`{"msg":"bar","offset":104}`+"\n", out.String())
+}
+
+type errorReader struct{}
+
+func (errorReader) Read([]byte) (int, error) {
+	return 0, assert.AnError
+}
+
+func TestTransformReadingInputError(t *testing.T) {
+	t.Parallel()
+
+	out := bytes.Buffer{}
+	err := regex2json.Transform(regexp.MustCompile(`^(?P<msg>.+)$`), errorReader{}, &out, &out, nil)
+	assert.ErrorIs(t, err, regex2json.ErrReadingInput)
+	assert.ErrorIs(t, err, assert.AnError)
+}
+
+func TestTransformerOrderFields(t *testing.T) {
+	t.Parallel()
+
+	tr := newTransformer(regexp.MustCompile(`^(?P<time>\S+) (?P<level>\S+) (?P<http__method>\S+) (?P<http__path>\S+) (?P<msg>.+)$`))
+	tr.UnmatchedKey = "msg"
+	tr.MetadataKeys.Line = "line"
+	tr.OrderFields = true
+	tr.FieldOrder = regex2json.ParseFieldOrder("level,http.path")
+	in := bytes.Buffer{}
+	_, err := in.WriteString("12:00 info GET /index done\nfailed\n")
+	require.NoError(t, err)
+	out := bytes.Buffer{}
+	err = tr.Transform(&in, &out, &out)
+	require.NoError(t, err, "% -+#.1v", err)
+	assert.Equal(t, `{"level":"info","http":{"path":"/index","method":"GET"},"time":"12:00","msg":"done","line":1}`+"\n"+
+		`{"msg":"failed","line":2}`+"\n",
+		out.String())
+}
+
+func TestTransformerOrderFieldsRegex(t *testing.T) {
+	// We modify global Patterns before the test is marked as parallel.
+	regex2json.Patterns["testOrder"] = regexp.MustCompile(`^(?P<zed>\S+) (?P<alpha__y>\S+) (?P<alpha__x>\S+)$`)
+
+	t.Parallel()
+
+	tr := newTransformer(regexp.MustCompile(`^(?P<msg>\S+) (?P<nested___regex__testOrder>\S+ \S+ \S+) (?P<___regex__testOrder>.+)$`))
+	tr.OrderFields = true
+	out := bytes.Buffer{}
+	err := tr.Transform(bytes.NewReader([]byte("m a b c d e f\n")), &out, &out)
+	require.NoError(t, err, "% -+#.1v", err)
+	assert.Equal(t, `{"msg":"m","nested":{"zed":"a","alpha":{"y":"b","x":"c"}},"zed":"d","alpha":{"y":"e","x":"f"}}`+"\n", out.String())
+}
+
+func TestTransformerOrderFieldsEscapedKeys(t *testing.T) {
+	t.Parallel()
+
+	tr := newTransformer(regexp.MustCompile(`^(?P<foo__x49_1>\S+) (?P<foo__x49_0>\S+) (?P<bar__I1>\S+)$`))
+	tr.OrderFields = true
+	out := bytes.Buffer{}
+	err := tr.Transform(bytes.NewReader([]byte("a b c\n")), &out, &out)
+	require.NoError(t, err, "% -+#.1v", err)
+	assert.Equal(t, `{"foo":{"I1":"a","I0":"b"},"bar":[null,"c"]}`+"\n", out.String())
+}
+
+func TestTransformerRecords(t *testing.T) {
+	t.Parallel()
+
+	tr := newTransformer(regexp.MustCompile(`^(?P<status___int>\S+) (?P<msg>.+)$`))
+	tr.MetadataKeys.Line = "line"
+
+	records := []*regex2json.Record{}
+	errs := []error{}
+	for record, err := range tr.Records(strings.NewReader("200 ok\n\nunmatched\nabc failed\n404 not found\n")) {
+		records = append(records, record)
+		errs = append(errs, err)
+	}
+
+	assert.Equal(t, []*regex2json.Record{
+		{Line: 1, Offset: 0, Raw: "200 ok", Matched: true, Fields: map[string]any{"status": int64(200), "msg": "ok", "line": 1}},
+		{Line: 3, Offset: 8, Raw: "unmatched", Matched: false, Fields: nil},
+		{Line: 4, Offset: 18, Raw: "abc failed", Matched: true, Fields: nil},
+		{Line: 5, Offset: 29, Raw: "404 not found", Matched: true, Fields: map[string]any{"status": int64(404), "msg": "not found", "line": 5}},
+	}, records)
+	require.Len(t, errs, 4)
+	assert.NoError(t, errs[0])
+	assert.NoError(t, errs[1])
+	var eErr *regex2json.ExpressionError
+	require.ErrorAs(t, errs[2], &eErr)
+	assert.Equal(t, 4, eErr.Line)
+	assert.NoError(t, errs[3])
+}
+
+func TestCompiledTransformerTransformLine(t *testing.T) {
+	t.Parallel()
+
+	tr := newTransformer(regexp.MustCompile(`^(?P<status___int>\S+) (?P<msg>.+)$`))
+	tr.MetadataKeys.Line = "line"
+	tr.MetadataKeys.Raw = "raw"
+
+	c, err := tr.Compile()
+	require.NoError(t, err, "% -+#.1v", err)
+
+	// Changes to the Transformer do not affect the compiled one.
+	tr.Regexp = regexp.MustCompile(`^(?P<other>.+)$`)
+
+	record, err := c.TransformLine([]byte("200 ok"))
+	require.NoError(t, err, "% -+#.1v", err)
+	assert.Equal(t, &regex2json.Record{
+		Line: 0, Offset: 0, Raw: "200 ok", Matched: true, Fields: map[string]any{"status": int64(200), "msg": "ok", "raw": "200 ok"},
+	}, record)
+
+	record, err = c.TransformLine([]byte("unmatched"))
+	require.NoError(t, err, "% -+#.1v", err)
+	assert.False(t, record.Matched)
+	assert.Nil(t, record.Fields)
+
+	_, err = c.TransformLine([]byte("abc failed"))
+	assert.ErrorIs(t, err, regex2json.ErrInvalidValue)
+
+	tr.Regexp = regexp.MustCompile(`^(?P<foo___unknown>.+)$`)
+	_, err = tr.Compile()
+	assert.ErrorIs(t, err, regex2json.ErrCompilingExpressions)
+
+	// Padding of arrays is null in records.
+	tr.Regexp = regexp.MustCompile(`^(?P<foo__I2>.+)$`)
+	tr.MetadataKeys.Line = ""
+	tr.MetadataKeys.Raw = ""
+	c, err = tr.Compile()
+	require.NoError(t, err, "% -+#.1v", err)
+	record, err = c.TransformLine([]byte("x"))
+	require.NoError(t, err, "% -+#.1v", err)
+	assert.Equal(t, map[string]any{"foo": []any{nil, nil, "x"}}, record.Fields)
+}
+
+func TestTransformerRegexMergeStrategy(t *testing.T) {
+	// We modify global Patterns before the test is marked as parallel.
+	regex2json.Patterns["testWords"] = regexp.MustCompile(`(?P<word>\w+)`)
+
+	t.Parallel()
+
+	tr := newTransformer(regexp.MustCompile(`^(?P<words___regex__testWords>.+)$`))
+	tr.MergeStrategy = regex2json.MergeLast
+
+	c, err := tr.Compile()
+	require.NoError(t, err, "% -+#.1v", err)
+	record, err := c.TransformLine([]byte("foo bar"))
+	require.NoError(t, err, "% -+#.1v", err)
+	assert.Equal(t, map[string]any{"words": map[string]any{"word": "bar"}}, record.Fields)
+}
+
+func TestTransformerTransformWith(t *testing.T) {
+	t.Parallel()
+
+	tr := newTransformer(regexp.MustCompile(`^(?P<status___int>\S+) (?P<msg>.+)$`))
+
+	matched := bytes.Buffer{}
+	unmatched := bytes.Buffer{}
+	encoder := regex2json.NewCSVEncoder(&matched, ',', nil)
+	unmatchedEncoder := regex2json.NewCSVEncoder(&unmatched, ',', nil)
+	// The same encoders are used for multiple inputs, so the header is written only once.
+	for _, in := range []string{"200 ok\nunmatched\n", "404 not found\n"} {
+		err := tr.TransformWith(strings.NewReader(in), encoder, &unmatched, unmatchedEncoder)
+		require.NoError(t, err, "% -+#.1v", err)
+	}
+	assert.Equal(t, "msg,status\nok,200\nnot found,404\n", matched.String())
+	assert.Equal(t, "unmatched\n", unmatched.String())
+}
@@ -0,0 +1,123 @@
+package regex2json
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+func parseQueryArgs(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	} else if len(args) > 1 {
+		return false, fmt.Errorf("%w: %s", ErrUnexpectedArgument, strings.Join(args[1:], ", "))
+	}
+	if args[0] != "multi" {
+		return false, fmt.Errorf("%w: %s", ErrUnexpectedArgument, args[0])
+	}
+	return true, nil
+}
+
+func parseQuery(query string, multi bool) (map[string]any, error) {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf(`%w: unable to parse "%s" into query: %w`, ErrInvalidValue, query, err)
+	}
+	res := map[string]any{}
+	for key, vs := range values {
+		if multi && len(vs) > 1 {
+			a := make([]any, 0, len(vs))
+			for _, v := range vs {
+				a = append(a, v)
+			}
+			res[key] = a
+		} else {
+			res[key] = vs[0]
+		}
+	}
+	return res, nil
+}
+
+// URLOperator returns the url operator which parses the input string
+// as URL using [url.Parse] into an object with scheme, host, port, path,
+// query, and fragment fields. Fields which are empty in the URL are omitted.
+// Port is an int. Query is an object of query parameters
+// (see [QueryOperator] for details).
+//
+// It accepts one optional argument, multi, in which case values of query
+// parameters which are repeated are collected into an array.
+// Otherwise only the first value is used.
+func URLOperator(args ...string) (Op, error) {
+	multi, err := parseQueryArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	return func(in any) (any, error) {
+		s, skip, err := toStringOrSkip(in)
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			return in, nil
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf(`%w: unable to parse "%s" into URL: %w`, ErrInvalidValue, s, err)
+		}
+		res := map[string]any{}
+		if u.Scheme != "" {
+			res["scheme"] = u.Scheme
+		}
+		if host := u.Hostname(); host != "" {
+			res["host"] = host
+		}
+		if port := u.Port(); port != "" {
+			p, err := strconv.ParseInt(port, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf(`%w: unable to parse port "%s" of URL "%s": %w`, ErrInvalidValue, port, s, err)
+			}
+			res["port"] = p
+		}
+		if u.Path != "" {
+			res["path"] = u.Path
+		} else if u.Opaque != "" {
+			res["path"] = u.Opaque
+		}
+		if u.RawQuery != "" {
+			query, err := parseQuery(u.RawQuery, multi)
+			if err != nil {
+				return nil, err
+			}
+			res["query"] = query
+		}
+		if u.Fragment != "" {
+			res["fragment"] = u.Fragment
+		}
+		return res, nil
+	}, nil
+}
+
+// QueryOperator returns the query operator which parses the input string
+// as URL query string using [url.ParseQuery] into an object of query
+// parameters. Keys and values are decoded. Leading ? is ignored.
+//
+// It accepts one optional argument, multi, in which case values of query
+// parameters which are repeated are collected into an array.
+// Otherwise only the first value is used.
+func QueryOperator(args ...string) (Op, error) {
+	multi, err := parseQueryArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	return func(in any) (any, error) {
+		s, skip, err := toStringOrSkip(in)
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			return in, nil
+		}
+		return parseQuery(strings.TrimPrefix(s, "?"), multi)
+	}, nil
+}
@@ -0,0 +1,169 @@
+package regex2json
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+//go:embed useragent.json
+var defaultUserAgentRules []byte
+
+type userAgentRule struct {
+	Regex string `json:"regex"`
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+
+	regexp *regexp.Regexp
+}
+
+func (r *userAgentRule) match(s string) (bool, string) {
+	match := r.regexp.FindStringSubmatch(s)
+	if match == nil {
+		return false, ""
+	}
+	i := r.regexp.SubexpIndex("version")
+	if i < 0 {
+		return true, ""
+	}
+	// Some versions (e.g., of iOS and macOS) use _ instead of . as a separator.
+	return true, strings.ReplaceAll(match[i], "_", ".")
+}
+
+// UserAgentRules are rules used by [UserAgentOperator] to parse user agent strings.
+//
+// Rules are a JSON object with bots, browsers, os, and devices fields, each an array
+// of rules. Every rule has a regex field with a regexp and a name field (or type
+// field for devices). The regexp can have a capture group named version.
+// Rules are tried in order and the first matching rule is used.
+//
+// Use [LoadUserAgentRules] to create UserAgentRules.
+type UserAgentRules struct {
+	bots     []*userAgentRule
+	browsers []*userAgentRule
+	os       []*userAgentRule
+	devices  []*userAgentRule
+}
+
+// LoadUserAgentRules loads user agent rules from JSON.
+func LoadUserAgentRules(in io.Reader) (*UserAgentRules, error) {
+	var data struct {
+		Bots     []*userAgentRule `json:"bots"`
+		Browsers []*userAgentRule `json:"browsers"`
+		OS       []*userAgentRule `json:"os"`
+		Devices  []*userAgentRule `json:"devices"`
+	}
+	decoder := json.NewDecoder(in)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unable to parse user agent rules: %w", ErrInvalidValue, err)
+	}
+	for _, rs := range [][]*userAgentRule{data.Bots, data.Browsers, data.OS, data.Devices} {
+		for _, rule := range rs {
+			rule.regexp, err = regexp.Compile(rule.Regex)
+			if err != nil {
+				return nil, fmt.Errorf(`%w: invalid user agent rule regexp "%s": %w`, ErrInvalidValue, rule.Regex, err)
+			}
+		}
+	}
+	return &UserAgentRules{
+		bots:     data.Bots,
+		browsers: data.Browsers,
+		os:       data.OS,
+		devices:  data.Devices,
+	}, nil
+}
+
+// UserAgent are user agent rules used by [UserAgentOperator].
+// By default, rules embedded in the package are used.
+var UserAgent = mustLoadUserAgentRules(defaultUserAgentRules) //nolint:gochecknoglobals
+
+func mustLoadUserAgentRules(data []byte) *UserAgentRules {
+	rules, err := LoadUserAgentRules(strings.NewReader(string(data)))
+	if err != nil {
+		panic(err)
+	}
+	return rules
+}
+
+// Parse parses the user agent string into an object with browser, version,
+// os, osVersion, device, and bot fields. Fields which could not be determined
+// are omitted. Device is one of desktop, mobile, tablet, or bot. Bot is a bool.
+// For bots, browser is the name of the bot (if known).
+func (r *UserAgentRules) Parse(s string) map[string]any {
+	res := map[string]any{}
+
+	bot := false
+	for _, rule := range r.bots {
+		if ok, version := rule.match(s); ok {
+			bot = true
+			if rule.Name != "" {
+				res["browser"] = rule.Name
+				if version != "" {
+					res["version"] = version
+				}
+			}
+			break
+		}
+	}
+	if !bot {
+		for _, rule := range r.browsers {
+			if ok, version := rule.match(s); ok {
+				res["browser"] = rule.Name
+				if version != "" {
+					res["version"] = version
+				}
+				break
+			}
+		}
+	}
+	for _, rule := range r.os {
+		if ok, version := rule.match(s); ok {
+			res["os"] = rule.Name
+			if version != "" {
+				res["osVersion"] = version
+			}
+			break
+		}
+	}
+	res["bot"] = bot
+	if bot {
+		res["device"] = "bot"
+	} else {
+		res["device"] = "desktop"
+		for _, rule := range r.devices {
+			if ok, _ := rule.match(s); ok {
+				res["device"] = rule.Type
+				break
+			}
+		}
+	}
+
+	return res
+}
+
+// UserAgentOperator returns the useragent operator which parses the input
+// string as user agent string using [UserAgent] rules. See [UserAgentRules.Parse]
+// for details about the output.
+//
+// It does not expect any arguments.
+func UserAgentOperator(args ...string) (Op, error) {
+	if len(args) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrUnexpectedArgument, strings.Join(args, ", "))
+	}
+	rules := UserAgent
+	return func(in any) (any, error) {
+		s, skip, err := toStringOrSkip(in)
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			return in, nil
+		}
+		return rules.Parse(s), nil
+	}, nil
+}
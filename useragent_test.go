@@ -0,0 +1,32 @@
+package regex2json_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/tozd/regex2json"
+)
+
+func TestLoadUserAgentRules(t *testing.T) {
+	t.Parallel()
+
+	rules, err := regex2json.LoadUserAgentRules(strings.NewReader(`{
+		"bots": [{"regex": "^internal-probe/(?P<version>\\d+)", "name": "Probe"}],
+		"browsers": [{"regex": "^MyApp/(?P<version>[\\d_]+)", "name": "MyApp"}],
+		"os": [],
+		"devices": [{"regex": "Kiosk", "type": "kiosk"}]
+	}`))
+	require.NoError(t, err, "% -+#.1v", err)
+
+	assert.Equal(t, map[string]any{"bot": false, "browser": "MyApp", "version": "1.2", "device": "kiosk"}, rules.Parse("MyApp/1_2 Kiosk"))
+	assert.Equal(t, map[string]any{"bot": true, "browser": "Probe", "version": "3", "device": "bot"}, rules.Parse("internal-probe/3"))
+	assert.Equal(t, map[string]any{"bot": false, "device": "desktop"}, rules.Parse("Unknown"))
+
+	_, err = regex2json.LoadUserAgentRules(strings.NewReader(`{"bots": [{"regex": "("}]}`))
+	assert.EqualError(t, err, "invalid value: invalid user agent rule regexp \"(\": error parsing regexp: missing closing ): `(`")
+	_, err = regex2json.LoadUserAgentRules(strings.NewReader(`{"unknown": []}`))
+	assert.EqualError(t, err, `invalid value: unable to parse user agent rules: json: unknown field "unknown"`)
+}